@@ -0,0 +1,226 @@
+package stulbe
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/strimertul/stulbe/api"
+	"github.com/strimertul/stulbe/auth"
+)
+
+func (b *Backend) apiChangeKey(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(authKey).(*auth.UserClaims)
+
+	var payload api.ChangeKeyRequest
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		jsonErr(w, fmt.Sprintf("invalid json body: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	if payload.NewKey == "" {
+		jsonErr(w, "missing new key", http.StatusBadRequest)
+		return
+	}
+
+	err = b.Auth.ChangeKey(r.Context(), claims.User, payload.OldKey, payload.NewKey, b.clientIP(r))
+	if err != nil {
+		if err == auth.ErrInvalidKey {
+			jsonErr(w, "invalid credentials", http.StatusUnauthorized)
+			return
+		}
+		if lockout, ok := err.(*auth.LockoutError); ok {
+			tooManyAttempts(w, lockout)
+			return
+		}
+		b.httpLogger.Error("internal error while changing key", zap.Error(err))
+		serverError(w, err)
+		return
+	}
+
+	b.httpLogger.Info("user changed key", zap.String("user", claims.User))
+	jsonResponse(w, api.StatusResponse{Ok: true})
+}
+
+func (b *Backend) apiResetKey(w http.ResponseWriter, r *http.Request) {
+	var payload api.ResetKeyRequest
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		jsonErr(w, fmt.Sprintf("invalid json body: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	if payload.NewKey == "" {
+		jsonErr(w, "missing new key", http.StatusBadRequest)
+		return
+	}
+
+	user, err := b.Auth.RedeemResetToken(r.Context(), payload.Token, payload.NewKey)
+	if err != nil {
+		if err == auth.ErrInvalidResetToken || err == auth.ErrUserNotFound {
+			jsonErr(w, "invalid or expired reset token", http.StatusUnauthorized)
+			return
+		}
+		b.httpLogger.Error("internal error while resetting key", zap.Error(err))
+		serverError(w, err)
+		return
+	}
+
+	b.httpLogger.Info("user reset key", zap.String("user", user))
+	jsonResponse(w, api.StatusResponse{Ok: true})
+}
+
+func (b *Backend) apiRegister(w http.ResponseWriter, r *http.Request) {
+	var payload api.RegisterRequest
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		jsonErr(w, fmt.Sprintf("invalid json body: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	invite, err := b.Auth.RedeemInvite(r.Context(), payload.Code, payload.User, payload.AuthKey)
+	if err != nil {
+		switch err {
+		case auth.ErrInvalidInvite:
+			jsonErr(w, "invalid or expired invite code", http.StatusUnauthorized)
+		case auth.ErrInvalidUsername:
+			jsonErr(w, "invalid user name", http.StatusBadRequest)
+		case auth.ErrInvalidKey:
+			jsonErr(w, "missing key", http.StatusBadRequest)
+		case auth.ErrUserExists:
+			jsonErr(w, "user already exists", http.StatusConflict)
+		default:
+			b.httpLogger.Error("internal error while redeeming invite", zap.Error(err))
+			serverError(w, err)
+		}
+		return
+	}
+
+	b.httpLogger.Info("user registered with invite", zap.String("user", payload.User), zap.String("invite", invite.ID))
+	jsonResponse(w, api.RegisterResponse{
+		Ok:    true,
+		User:  payload.User,
+		Level: string(auth.ULStreamer),
+	})
+}
+
+func (b *Backend) apiTOTPEnroll(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(authKey).(*auth.UserClaims)
+
+	secret, uri, err := b.Auth.BeginTOTPEnrollment(r.Context(), claims.User)
+	if err != nil {
+		if err == auth.ErrTOTPAlreadyEnabled {
+			jsonErr(w, "totp already enabled", http.StatusConflict)
+			return
+		}
+		b.httpLogger.Error("internal error while enrolling totp", zap.Error(err))
+		serverError(w, err)
+		return
+	}
+
+	jsonResponse(w, api.TOTPEnrollResponse{
+		Ok:     true,
+		Secret: secret,
+		URI:    uri,
+	})
+}
+
+func (b *Backend) apiTOTPConfirm(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(authKey).(*auth.UserClaims)
+
+	var payload api.TOTPCodeRequest
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		jsonErr(w, fmt.Sprintf("invalid json body: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	codes, err := b.Auth.ConfirmTOTP(r.Context(), claims.User, payload.Code)
+	if err != nil {
+		switch err {
+		case auth.ErrInvalidOTP:
+			jsonErr(w, "invalid otp", http.StatusBadRequest)
+		case auth.ErrTOTPNotEnrolled:
+			jsonErr(w, "totp enrollment not started", http.StatusBadRequest)
+		case auth.ErrTOTPAlreadyEnabled:
+			jsonErr(w, "totp already enabled", http.StatusConflict)
+		default:
+			b.httpLogger.Error("internal error while confirming totp", zap.Error(err))
+			serverError(w, err)
+		}
+		return
+	}
+
+	b.httpLogger.Info("user enabled totp", zap.String("user", claims.User))
+	jsonResponse(w, api.TOTPConfirmResponse{
+		Ok:            true,
+		RecoveryCodes: codes,
+	})
+}
+
+func (b *Backend) apiTOTPDisable(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(authKey).(*auth.UserClaims)
+
+	var payload api.TOTPCodeRequest
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		jsonErr(w, fmt.Sprintf("invalid json body: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	err = b.Auth.DisableTOTP(r.Context(), claims.User, payload.Code, b.clientIP(r))
+	if err != nil {
+		if lockout, ok := err.(*auth.LockoutError); ok {
+			tooManyAttempts(w, lockout)
+			return
+		}
+		switch err {
+		case auth.ErrInvalidOTP, auth.ErrOTPRequired:
+			jsonErr(w, "invalid otp", http.StatusBadRequest)
+		case auth.ErrTOTPNotEnabled:
+			jsonErr(w, "totp not enabled", http.StatusBadRequest)
+		default:
+			b.httpLogger.Error("internal error while disabling totp", zap.Error(err))
+			serverError(w, err)
+		}
+		return
+	}
+
+	b.httpLogger.Info("user disabled totp", zap.String("user", claims.User))
+	jsonResponse(w, api.StatusResponse{Ok: true})
+}
+
+// apiMe describes the token used for the request and the user it belongs to
+func (b *Backend) apiMe(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(authKey).(*auth.UserClaims)
+
+	permissions := claims.Level.Permissions()
+	permissionNames := make([]string, len(permissions))
+	for i, perm := range permissions {
+		permissionNames[i] = string(perm)
+	}
+
+	response := api.MeResponse{
+		Ok:          true,
+		User:        claims.User,
+		Level:       string(claims.Level),
+		Permissions: permissionNames,
+		Scopes:      claims.Scopes,
+		SessionID:   claims.Id,
+		IssuedAt:    time.Unix(claims.IssuedAt, 0),
+		ExpiresAt:   time.Unix(claims.ExpiresAt, 0),
+	}
+
+	linked, twitchID, err := b.twitchUserID(r.Context(), claims.User)
+	if err != nil {
+		b.httpLogger.Error("could not read twitch account", zap.String("user", claims.User), zap.Error(err))
+		serverError(w, err)
+		return
+	}
+	response.TwitchLinked = linked
+	response.TwitchUserID = twitchID
+
+	jsonResponse(w, response)
+}
@@ -0,0 +1,620 @@
+package stulbe
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	kv "github.com/strimertul/kilovolt/v8"
+	"go.uber.org/zap"
+
+	"github.com/strimertul/stulbe/api"
+	"github.com/strimertul/stulbe/audit"
+	"github.com/strimertul/stulbe/auth"
+	"github.com/strimertul/stulbe/backup"
+)
+
+const (
+	resetTokenDefaultLifetime = time.Hour * 24
+	inviteDefaultLifetime     = time.Hour * 24 * 7
+)
+
+func (b *Backend) apiAdminListUsers(w http.ResponseWriter, r *http.Request) {
+	users := b.Auth.ListUsers()
+	out := make([]api.UserInfo, len(users))
+	for i, user := range users {
+		out[i] = api.UserInfo{
+			User:  user.User,
+			Level: string(user.Level),
+			TOTP:  user.TOTPEnabled(),
+		}
+	}
+	jsonResponse(w, api.AdminUserListResponse{
+		Ok:    true,
+		Users: out,
+	})
+}
+
+func (b *Backend) apiAdminCreateUser(w http.ResponseWriter, r *http.Request) {
+	var payload api.AdminUserCreateRequest
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		jsonErr(w, fmt.Sprintf("invalid json body: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	if !auth.ValidUsername(payload.User) {
+		jsonErr(w, "invalid user name", http.StatusBadRequest)
+		return
+	}
+	level := auth.UserLevel(payload.Level)
+	if level == "" {
+		level = auth.ULStreamer
+	}
+	if !level.Valid() {
+		jsonErr(w, "invalid level", http.StatusBadRequest)
+		return
+	}
+	// Generate a key if none was provided
+	key := payload.AuthKey
+	if key == "" {
+		key, err = auth.GenerateKey()
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+	}
+
+	err = b.Auth.CreateUser(r.Context(), payload.User, key, level)
+	if err != nil {
+		if err == auth.ErrUserExists {
+			jsonErr(w, "user already exists", http.StatusConflict)
+			return
+		}
+		b.httpLogger.Error("internal error while creating user", zap.Error(err))
+		serverError(w, err)
+		return
+	}
+
+	b.httpLogger.Info("created user", zap.String("user", payload.User), zap.String("level", string(level)))
+	jsonResponse(w, api.AdminUserKeyResponse{
+		Ok:      true,
+		User:    payload.User,
+		Level:   string(level),
+		AuthKey: key,
+	})
+}
+
+func (b *Backend) apiAdminSetUserLevel(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["user"]
+	claims := r.Context().Value(authKey).(*auth.UserClaims)
+
+	var payload api.AdminUserLevelRequest
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		jsonErr(w, fmt.Sprintf("invalid json body: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	// Don't let admins lock themselves out
+	if username == claims.User {
+		jsonErr(w, "cannot change your own level", http.StatusBadRequest)
+		return
+	}
+
+	err = b.Auth.SetUserLevel(r.Context(), username, auth.UserLevel(payload.Level))
+	if err != nil {
+		switch err {
+		case auth.ErrUserNotFound:
+			jsonErr(w, "user not found", http.StatusNotFound)
+		case auth.ErrInvalidLevel:
+			jsonErr(w, "invalid level", http.StatusBadRequest)
+		default:
+			b.httpLogger.Error("internal error while updating user", zap.Error(err))
+			serverError(w, err)
+		}
+		return
+	}
+
+	b.httpLogger.Info("changed user level", zap.String("user", username), zap.String("level", payload.Level))
+	jsonResponse(w, api.StatusResponse{Ok: true})
+}
+
+func (b *Backend) apiAdminResetUserKey(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["user"]
+
+	var payload api.AdminUserKeyRequest
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		jsonErr(w, fmt.Sprintf("invalid json body: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	user, ok := b.Auth.GetUser(username)
+	if !ok {
+		jsonErr(w, "user not found", http.StatusNotFound)
+		return
+	}
+
+	// Generate a key if none was provided
+	key := payload.AuthKey
+	if key == "" {
+		key, err = auth.GenerateKey()
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+	}
+
+	err = b.Auth.SetUserKey(r.Context(), username, key)
+	if err != nil {
+		b.httpLogger.Error("internal error while resetting key", zap.Error(err))
+		serverError(w, err)
+		return
+	}
+
+	b.httpLogger.Info("reset user key", zap.String("user", username))
+	jsonResponse(w, api.AdminUserKeyResponse{
+		Ok:      true,
+		User:    user.User,
+		Level:   string(user.Level),
+		AuthKey: key,
+	})
+}
+
+func (b *Backend) apiAdminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["user"]
+	claims := r.Context().Value(authKey).(*auth.UserClaims)
+
+	// Don't let admins lock themselves out
+	if username == claims.User {
+		jsonErr(w, "cannot delete yourself", http.StatusBadRequest)
+		return
+	}
+
+	err := b.Auth.DeleteUser(r.Context(), username)
+	if err != nil {
+		if err == auth.ErrUserNotFound {
+			jsonErr(w, "user not found", http.StatusNotFound)
+			return
+		}
+		b.httpLogger.Error("internal error while deleting user", zap.Error(err))
+		serverError(w, err)
+		return
+	}
+
+	b.httpLogger.Info("deleted user", zap.String("user", username))
+	jsonResponse(w, api.StatusResponse{Ok: true})
+}
+
+func signingKeyList(keys []auth.SigningKey) []api.SigningKeyInfo {
+	out := make([]api.SigningKeyInfo, len(keys))
+	for i, key := range keys {
+		out[i] = api.SigningKeyInfo{
+			ID:        key.ID,
+			CreatedAt: key.CreatedAt,
+			RetiresAt: key.RetiresAt,
+			Active:    i == len(keys)-1,
+		}
+	}
+	return out
+}
+
+func (b *Backend) apiAdminListKeys(w http.ResponseWriter, r *http.Request) {
+	jsonResponse(w, api.SigningKeyListResponse{
+		Ok:   true,
+		Keys: signingKeyList(b.Auth.ListKeys()),
+	})
+}
+
+func (b *Backend) apiAdminRotateKey(w http.ResponseWriter, r *http.Request) {
+	var payload api.SigningKeyRotateRequest
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil && err != io.EOF {
+		jsonErr(w, fmt.Sprintf("invalid json body: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	grace := b.Auth.MaxTokenLifetime()
+	if payload.Grace != "" {
+		grace, err = time.ParseDuration(payload.Grace)
+		if err != nil || grace < 0 {
+			jsonErr(w, "invalid grace period", http.StatusBadRequest)
+			return
+		}
+	}
+
+	_, err = b.Auth.RotateKey(r.Context(), grace)
+	if err != nil {
+		b.httpLogger.Error("internal error while rotating keys", zap.Error(err))
+		serverError(w, err)
+		return
+	}
+
+	jsonResponse(w, api.SigningKeyListResponse{
+		Ok:   true,
+		Keys: signingKeyList(b.Auth.ListKeys()),
+	})
+}
+
+func backupInfo(snapshot backup.Snapshot) api.BackupInfo {
+	return api.BackupInfo{
+		Name:      snapshot.Name,
+		Size:      snapshot.Size,
+		CreatedAt: snapshot.CreatedAt,
+	}
+}
+
+func (b *Backend) apiAdminListBackups(w http.ResponseWriter, r *http.Request) {
+	if b.config.Backups == nil {
+		jsonErr(w, "backups are not available with this storage", http.StatusNotImplemented)
+		return
+	}
+
+	snapshots, err := b.config.Backups.List()
+	if err != nil {
+		b.httpLogger.Error("internal error while listing backups", zap.Error(err))
+		serverError(w, err)
+		return
+	}
+
+	out := make([]api.BackupInfo, len(snapshots))
+	for i, snapshot := range snapshots {
+		out[i] = backupInfo(snapshot)
+	}
+	jsonResponse(w, api.BackupListResponse{
+		Ok:      true,
+		Backups: out,
+	})
+}
+
+func (b *Backend) apiAdminCreateBackup(w http.ResponseWriter, r *http.Request) {
+	if b.config.Backups == nil {
+		jsonErr(w, "backups are not available with this storage", http.StatusNotImplemented)
+		return
+	}
+
+	snapshot, err := b.config.Backups.Create()
+	if err != nil {
+		b.httpLogger.Error("internal error while creating backup", zap.Error(err))
+		serverError(w, err)
+		return
+	}
+
+	claims := r.Context().Value(authKey).(*auth.UserClaims)
+	b.httpLogger.Info("created backup", zap.String("by", claims.User), zap.String("name", snapshot.Name))
+	jsonResponse(w, api.BackupResponse{
+		Ok:      true,
+		Backup:  backupInfo(snapshot),
+		Version: snapshot.Version,
+	})
+}
+
+func (b *Backend) apiAdminListLockouts(w http.ResponseWriter, r *http.Request) {
+	lockouts, err := b.Auth.ListLockouts(r.Context())
+	if err != nil {
+		b.httpLogger.Error("internal error while listing lockouts", zap.Error(err))
+		serverError(w, err)
+		return
+	}
+
+	now := time.Now()
+	out := make([]api.LockoutInfo, len(lockouts))
+	for i, lockout := range lockouts {
+		out[i] = api.LockoutInfo{
+			Kind:        string(lockout.Kind),
+			ID:          lockout.ID,
+			Failures:    lockout.Failures,
+			LastFailure: lockout.LastFailure,
+			LockedUntil: lockout.LockedUntil,
+			Locked:      lockout.LockedUntil.After(now),
+		}
+	}
+	jsonResponse(w, api.LockoutListResponse{
+		Ok:       true,
+		Lockouts: out,
+	})
+}
+
+func (b *Backend) apiAdminClearLockout(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	kind := auth.LockoutKind(vars["kind"])
+	if !kind.Valid() {
+		jsonErr(w, "invalid lockout kind", http.StatusBadRequest)
+		return
+	}
+
+	err := b.Auth.ClearLockout(r.Context(), kind, vars["id"])
+	if err != nil {
+		if err == kv.ErrorKeyNotFound {
+			jsonErr(w, "lockout not found", http.StatusNotFound)
+			return
+		}
+		b.httpLogger.Error("internal error while clearing lockout", zap.Error(err))
+		serverError(w, err)
+		return
+	}
+
+	b.httpLogger.Info("cleared lockout", zap.String("kind", string(kind)), zap.String("id", vars["id"]))
+	jsonResponse(w, api.StatusResponse{Ok: true})
+}
+
+func (b *Backend) apiAdminCreateResetToken(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["user"]
+
+	var payload api.ResetTokenRequest
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil && err != io.EOF {
+		jsonErr(w, fmt.Sprintf("invalid json body: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	lifetime := resetTokenDefaultLifetime
+	if payload.ExpiresIn != "" {
+		lifetime, err = time.ParseDuration(payload.ExpiresIn)
+		if err != nil || lifetime <= 0 {
+			jsonErr(w, "invalid expiration", http.StatusBadRequest)
+			return
+		}
+	}
+
+	token, data, err := b.Auth.CreateResetToken(r.Context(), username, lifetime)
+	if err != nil {
+		if err == auth.ErrUserNotFound {
+			jsonErr(w, "user not found", http.StatusNotFound)
+			return
+		}
+		b.httpLogger.Error("internal error while creating reset token", zap.Error(err))
+		serverError(w, err)
+		return
+	}
+
+	b.httpLogger.Info("created reset token", zap.String("user", username), zap.Time("expires", data.ExpiresAt))
+	jsonResponse(w, api.ResetTokenResponse{
+		Ok:        true,
+		User:      data.User,
+		Token:     token,
+		ExpiresAt: data.ExpiresAt,
+	})
+}
+
+func (b *Backend) apiAdminListInvites(w http.ResponseWriter, r *http.Request) {
+	invites, err := b.Auth.ListInvites(r.Context())
+	if err != nil {
+		b.httpLogger.Error("internal error while listing invites", zap.Error(err))
+		serverError(w, err)
+		return
+	}
+
+	out := make([]api.InviteInfo, len(invites))
+	for i, invite := range invites {
+		out[i] = inviteInfo(invite)
+	}
+	jsonResponse(w, api.InviteListResponse{
+		Ok:      true,
+		Invites: out,
+	})
+}
+
+func (b *Backend) apiAdminCreateInvite(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(authKey).(*auth.UserClaims)
+
+	var payload api.InviteCreateRequest
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil && err != io.EOF {
+		jsonErr(w, fmt.Sprintf("invalid json body: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	lifetime := inviteDefaultLifetime
+	if payload.ExpiresIn != "" {
+		lifetime, err = time.ParseDuration(payload.ExpiresIn)
+		if err != nil || lifetime <= 0 {
+			jsonErr(w, "invalid expiration", http.StatusBadRequest)
+			return
+		}
+	}
+
+	code, invite, err := b.Auth.CreateInvite(r.Context(), claims.User, payload.Note, lifetime)
+	if err != nil {
+		b.httpLogger.Error("internal error while creating invite", zap.Error(err))
+		serverError(w, err)
+		return
+	}
+
+	b.httpLogger.Info("created invite", zap.String("id", invite.ID), zap.String("by", claims.User))
+	jsonResponse(w, api.InviteCreateResponse{
+		Ok:     true,
+		Invite: inviteInfo(invite),
+		Code:   code,
+	})
+}
+
+func (b *Backend) apiAdminDeleteInvite(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	err := b.Auth.DeleteInvite(r.Context(), id)
+	if err != nil {
+		if err == auth.ErrInviteNotFound {
+			jsonErr(w, "invite not found", http.StatusNotFound)
+			return
+		}
+		b.httpLogger.Error("internal error while deleting invite", zap.Error(err))
+		serverError(w, err)
+		return
+	}
+
+	b.httpLogger.Info("deleted invite", zap.String("id", id))
+	jsonResponse(w, api.StatusResponse{Ok: true})
+}
+
+func inviteInfo(invite auth.Invite) api.InviteInfo {
+	return api.InviteInfo{
+		ID:        invite.ID,
+		CreatedBy: invite.CreatedBy,
+		Note:      invite.Note,
+		CreatedAt: invite.CreatedAt,
+		ExpiresAt: invite.ExpiresAt,
+	}
+}
+
+func (b *Backend) apiAdminAuditLog(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := audit.Filter{
+		User:   query.Get("user"),
+		Action: audit.Action(query.Get("action")),
+	}
+
+	var err error
+	if from := query.Get("from"); from != "" {
+		filter.From, err = time.Parse(time.RFC3339, from)
+		if err != nil {
+			jsonErr(w, "invalid from time, must be RFC 3339", http.StatusBadRequest)
+			return
+		}
+	}
+	if to := query.Get("to"); to != "" {
+		filter.To, err = time.Parse(time.RFC3339, to)
+		if err != nil {
+			jsonErr(w, "invalid to time, must be RFC 3339", http.StatusBadRequest)
+			return
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil {
+			jsonErr(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, err := b.Audit.Query(r.Context(), filter)
+	if err != nil {
+		b.httpLogger.Error("internal error while querying audit log", zap.Error(err))
+		serverError(w, err)
+		return
+	}
+
+	out := make([]api.AuditEntry, len(entries))
+	for i, entry := range entries {
+		out[i] = api.AuditEntry{
+			ID:        entry.ID,
+			Time:      entry.Time,
+			User:      entry.User,
+			Action:    string(entry.Action),
+			Success:   entry.Success,
+			IP:        entry.IP,
+			UserAgent: entry.UserAgent,
+			Details:   entry.Details,
+		}
+	}
+	jsonResponse(w, api.AuditLogResponse{
+		Ok:      true,
+		Entries: out,
+	})
+}
+
+func (b *Backend) apiAdminResetTOTP(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["user"]
+
+	err := b.Auth.ResetTOTP(r.Context(), username)
+	if err != nil {
+		if err == auth.ErrUserNotFound {
+			jsonErr(w, "user not found", http.StatusNotFound)
+			return
+		}
+		b.httpLogger.Error("internal error while resetting totp", zap.Error(err))
+		serverError(w, err)
+		return
+	}
+
+	b.httpLogger.Info("reset totp", zap.String("user", username))
+	jsonResponse(w, api.StatusResponse{Ok: true})
+}
+
+func twitchAllowedInfo(allowed auth.AllowedTwitchUser) api.TwitchAllowedInfo {
+	return api.TwitchAllowedInfo{
+		TwitchID:  allowed.TwitchID,
+		User:      allowed.User,
+		Level:     string(allowed.Level),
+		CreatedBy: allowed.CreatedBy,
+		CreatedAt: allowed.CreatedAt,
+	}
+}
+
+func (b *Backend) apiAdminListTwitchAllowlist(w http.ResponseWriter, r *http.Request) {
+	allowlist, err := b.Auth.ListAllowedTwitchUsers(r.Context())
+	if err != nil {
+		b.httpLogger.Error("internal error while listing twitch allowlist", zap.Error(err))
+		serverError(w, err)
+		return
+	}
+
+	out := make([]api.TwitchAllowedInfo, len(allowlist))
+	for i, allowed := range allowlist {
+		out[i] = twitchAllowedInfo(allowed)
+	}
+	jsonResponse(w, api.TwitchAllowlistResponse{
+		Ok:    true,
+		Users: out,
+	})
+}
+
+func (b *Backend) apiAdminAllowTwitchUser(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(authKey).(*auth.UserClaims)
+	twitchID := mux.Vars(r)["id"]
+
+	var payload api.TwitchAllowRequest
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		jsonErr(w, fmt.Sprintf("invalid json body: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	level := auth.UserLevel(payload.Level)
+	if level == "" {
+		level = auth.ULStreamer
+	}
+
+	allowed, err := b.Auth.AllowTwitchUser(r.Context(), twitchID, payload.User, level, claims.User)
+	if err != nil {
+		switch err {
+		case auth.ErrInvalidUsername:
+			jsonErr(w, "invalid username", http.StatusBadRequest)
+		case auth.ErrInvalidLevel:
+			jsonErr(w, "invalid level", http.StatusBadRequest)
+		default:
+			b.httpLogger.Error("internal error while updating twitch allowlist", zap.Error(err))
+			serverError(w, err)
+		}
+		return
+	}
+
+	b.httpLogger.Info("allowed twitch user", zap.String("twitch-id", twitchID), zap.String("user", allowed.User))
+	jsonResponse(w, api.TwitchAllowResponse{
+		Ok:   true,
+		User: twitchAllowedInfo(allowed),
+	})
+}
+
+func (b *Backend) apiAdminRemoveTwitchUser(w http.ResponseWriter, r *http.Request) {
+	twitchID := mux.Vars(r)["id"]
+
+	err := b.Auth.RemoveAllowedTwitchUser(r.Context(), twitchID)
+	if err != nil {
+		if err == auth.ErrAllowedNotFound {
+			jsonErr(w, "twitch account not in allowlist", http.StatusNotFound)
+			return
+		}
+		b.httpLogger.Error("internal error while updating twitch allowlist", zap.Error(err))
+		serverError(w, err)
+		return
+	}
+
+	b.httpLogger.Info("removed twitch user from allowlist", zap.String("twitch-id", twitchID))
+	jsonResponse(w, api.StatusResponse{Ok: true})
+}
@@ -5,7 +5,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -15,10 +19,11 @@ import (
 	"github.com/gorilla/mux"
 	jsoniter "github.com/json-iterator/go"
 	"github.com/nicklaw5/helix/v2"
-	kv "github.com/strimertul/kilovolt/v8"
 
 	"github.com/strimertul/stulbe/api"
+	"github.com/strimertul/stulbe/audit"
 	"github.com/strimertul/stulbe/auth"
+	"github.com/strimertul/stulbe/database"
 )
 
 type APIError struct {
@@ -36,15 +41,10 @@ func (b *Backend) BindRoutes() *mux.Router {
 	router := mux.NewRouter()
 	apiRouter := router.PathPrefix("/api").Subrouter()
 	b.bindApiRoutes(apiRouter)
+	router.HandleFunc("/.well-known/jwks.json", b.apiJWKS).Methods("GET", "OPTIONS")
 	router.HandleFunc(b.redirectURL.Path, b.authorizeCallback)
 	router.HandleFunc(b.webhookURL.Path+"/{user}", b.webhookCallback)
-	router.HandleFunc("/ws", b.wrapAuth(func(w http.ResponseWriter, r *http.Request) {
-		// Get user context
-		claims := r.Context().Value(authKey).(*auth.UserClaims)
-		b.Hub.CreateWebsocketClient(w, r, kv.ClientOptions{
-			Namespace: userNamespace(claims.User),
-		})
-	}))
+	router.HandleFunc("/ws", b.wrapWebsocketAuth(b.serveWebsocket))
 	router.Use(Cors)
 	return router
 }
@@ -52,9 +52,42 @@ func (b *Backend) BindRoutes() *mux.Router {
 func (b *Backend) bindApiRoutes(r *mux.Router) {
 	get := r.Methods("GET", "OPTIONS").Subrouter()
 	post := r.Methods("POST", "OPTIONS").Subrouter()
+	put := r.Methods("PUT", "OPTIONS").Subrouter()
+	del := r.Methods("DELETE", "OPTIONS").Subrouter()
 
 	// Auth endpoint (for privileged apps)
 	post.HandleFunc("/auth", b.apiAuth)
+	post.HandleFunc("/auth/refresh", b.apiRefresh)
+	get.HandleFunc("/auth/twitch", b.apiTwitchLogin)
+	post.HandleFunc("/auth/twitch/complete", b.apiTwitchLoginComplete)
+	get.HandleFunc("/auth/me", b.wrapAnyToken(auth.PermAccount, b.apiMe))
+	get.HandleFunc("/auth/sessions", b.wrapAuth(auth.PermAccount, b.apiListSessions))
+	del.HandleFunc("/auth/sessions/{id}", b.wrapAuth(auth.PermAccount, b.apiRevokeSession))
+	get.HandleFunc("/auth/keys", b.wrapAuth(auth.PermAccount, b.apiListAPIKeys))
+	post.HandleFunc("/auth/keys", b.wrapAuth(auth.PermAccount, b.apiCreateAPIKey))
+	del.HandleFunc("/auth/keys/{id}", b.wrapAuth(auth.PermAccount, b.apiRevokeSession))
+	post.HandleFunc("/auth/change-key", b.wrapAuth(auth.PermAccount, b.apiChangeKey))
+	post.HandleFunc("/auth/reset", b.apiResetKey)
+	post.HandleFunc("/auth/register", b.apiRegister)
+	post.HandleFunc("/auth/totp/enroll", b.wrapAuth(auth.PermAccount, b.apiTOTPEnroll))
+	post.HandleFunc("/auth/totp/confirm", b.wrapAuth(auth.PermAccount, b.apiTOTPConfirm))
+	post.HandleFunc("/auth/totp/disable", b.wrapAuth(auth.PermAccount, b.apiTOTPDisable))
+
+	// Delegated access to namespaces
+	get.HandleFunc("/auth/grants", b.wrapAuth(auth.PermNamespace, b.apiListGrants))
+	get.HandleFunc("/auth/grants/received", b.wrapAuth(auth.PermAccount, b.apiListReceivedGrants))
+	put.HandleFunc("/auth/grants/{user}", b.wrapAuth(auth.PermNamespace, b.apiSetGrant))
+	del.HandleFunc("/auth/grants/{user}", b.wrapAuth(auth.PermNamespace, b.apiRevokeGrant))
+	del.HandleFunc("/auth/grants/received/{owner}", b.wrapAuth(auth.PermAccount, b.apiDropGrant))
+
+	// KV access over HTTP, for the user's namespace or one they have a grant for
+	del.HandleFunc("/kv/key", b.wrapAnyToken(auth.PermAccount, b.apiKVDeleteKey))
+	del.HandleFunc("/kv/prefix", b.wrapAnyToken(auth.PermAccount, b.apiKVDeletePrefix))
+	get.HandleFunc("/kv/export", b.wrapAnyToken(auth.PermAccount, b.apiKVExport))
+	post.HandleFunc("/kv/import", b.wrapAnyToken(auth.PermAccount, b.apiKVImport))
+
+	// Tickets for opening websocket connections without headers
+	post.HandleFunc("/ws/ticket", b.wrapAnyToken(auth.PermAccount, b.apiWebsocketTicket))
 
 	// Loyalty endpoints (public)
 	get.HandleFunc("/stream/{channelID}/loyalty/config", b.apiLoyaltyConfig)
@@ -62,16 +95,51 @@ func (b *Backend) bindApiRoutes(r *mux.Router) {
 	get.HandleFunc("/stream/{channelID}/loyalty/goals", b.apiLoyaltyGoals)
 	get.HandleFunc("/stream/{channelID}/loyalty/info/{uid}", b.apiLoyaltyUserData)
 
-	post.HandleFunc("/twitch/authorize", b.wrapAuth(b.apiTwitchAuthRedirect))
-	get.HandleFunc("/twitch/user", b.wrapAuth(b.apiTwitchUserData))
-	get.HandleFunc("/twitch/list", b.wrapAuth(b.apiTwitchListSubscriptions))
-	post.HandleFunc("/twitch/clear", b.wrapAuth(b.apiTwitchClearSubscriptions))
+	post.HandleFunc("/twitch/authorize", b.wrapAuth(auth.PermTwitchLink, b.apiTwitchAuthRedirect))
+	get.HandleFunc("/twitch/user", b.wrapScope(auth.PermTwitchRead, auth.ScopeTwitchRead, b.apiTwitchUserData))
+	get.HandleFunc("/twitch/list", b.wrapAuth(auth.PermTwitchSubscriptions, b.apiTwitchListSubscriptions))
+	post.HandleFunc("/twitch/clear", b.wrapAuth(auth.PermTwitchSubscriptions, b.apiTwitchClearSubscriptions))
+
+	// User management
+	get.HandleFunc("/admin/users", b.wrapAuth(auth.PermManageUsers, b.apiAdminListUsers))
+	post.HandleFunc("/admin/users", b.wrapAuth(auth.PermManageUsers, b.apiAdminCreateUser))
+	put.HandleFunc("/admin/users/{user}/level", b.wrapAuth(auth.PermManageUsers, b.apiAdminSetUserLevel))
+	post.HandleFunc("/admin/users/{user}/key", b.wrapAuth(auth.PermManageUsers, b.apiAdminResetUserKey))
+	post.HandleFunc("/admin/users/{user}/reset-token", b.wrapAuth(auth.PermManageUsers, b.apiAdminCreateResetToken))
+	del.HandleFunc("/admin/users/{user}", b.wrapAuth(auth.PermManageUsers, b.apiAdminDeleteUser))
+	del.HandleFunc("/admin/users/{user}/totp", b.wrapAuth(auth.PermManageUsers, b.apiAdminResetTOTP))
+	get.HandleFunc("/admin/users/{user}/sessions", b.wrapAuth(auth.PermManageUsers, b.apiAdminListSessions))
+	del.HandleFunc("/admin/users/{user}/sessions", b.wrapAuth(auth.PermManageUsers, b.apiAdminRevokeAllSessions))
+	del.HandleFunc("/admin/users/{user}/sessions/{id}", b.wrapAuth(auth.PermManageUsers, b.apiAdminRevokeSession))
+
+	// Twitch accounts that can log in without being linked first
+	get.HandleFunc("/admin/twitch-allowlist", b.wrapAuth(auth.PermManageUsers, b.apiAdminListTwitchAllowlist))
+	put.HandleFunc("/admin/twitch-allowlist/{id}", b.wrapAuth(auth.PermManageUsers, b.apiAdminAllowTwitchUser))
+	del.HandleFunc("/admin/twitch-allowlist/{id}", b.wrapAuth(auth.PermManageUsers, b.apiAdminRemoveTwitchUser))
+
+	// Signing key management
+	get.HandleFunc("/admin/keys", b.wrapAuth(auth.PermManageKeys, b.apiAdminListKeys))
+	post.HandleFunc("/admin/keys/rotate", b.wrapAuth(auth.PermManageKeys, b.apiAdminRotateKey))
+
+	// Invite codes
+	get.HandleFunc("/admin/invites", b.wrapAuth(auth.PermManageInvites, b.apiAdminListInvites))
+	post.HandleFunc("/admin/invites", b.wrapAuth(auth.PermManageInvites, b.apiAdminCreateInvite))
+	del.HandleFunc("/admin/invites/{id}", b.wrapAuth(auth.PermManageInvites, b.apiAdminDeleteInvite))
+
+	// Audit log
+	get.HandleFunc("/admin/audit", b.wrapAuth(auth.PermViewAudit, b.apiAdminAuditLog))
+	get.HandleFunc("/admin/backups", b.wrapAuth(auth.PermManageBackups, b.apiAdminListBackups))
+	post.HandleFunc("/admin/backups", b.wrapAuth(auth.PermManageBackups, b.apiAdminCreateBackup))
+
+	// Failed login lockouts
+	get.HandleFunc("/admin/lockouts", b.wrapAuth(auth.PermManageLockouts, b.apiAdminListLockouts))
+	del.HandleFunc("/admin/lockouts/{kind}/{id}", b.wrapAuth(auth.PermManageLockouts, b.apiAdminClearLockout))
 }
 
 func Cors(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
 		w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Authorization")
 
 		if r.Method == "OPTIONS" {
@@ -84,7 +152,31 @@ func Cors(next http.Handler) http.Handler {
 
 // wrapAuth implements Basic Auth authorization for provided endpoints
 // This is not as secure as it should be but it will probably work ok for now
-func (b *Backend) wrapAuth(handler http.HandlerFunc) http.HandlerFunc {
+// Scoped tokens (API keys) are rejected, use wrapScope for endpoints they can access
+func (b *Backend) wrapAuth(perm auth.Permission, handler http.HandlerFunc) http.HandlerFunc {
+	return b.wrapClaims(perm, func(claims *auth.UserClaims) bool {
+		return !claims.Scoped()
+	}, handler)
+}
+
+// wrapScope authorizes full access tokens and scoped tokens with the given scope
+func (b *Backend) wrapScope(perm auth.Permission, scope string, handler http.HandlerFunc) http.HandlerFunc {
+	return b.wrapClaims(perm, func(claims *auth.UserClaims) bool {
+		return claims.HasScope(scope)
+	}, handler)
+}
+
+// wrapAnyToken authorizes any valid token, the handler must check scopes by itself
+func (b *Backend) wrapAnyToken(perm auth.Permission, handler http.HandlerFunc) http.HandlerFunc {
+	return b.wrapClaims(perm, func(*auth.UserClaims) bool {
+		return true
+	}, handler)
+}
+
+// wrapClaims is the middleware every authenticated route goes through, it
+// verifies the token, checks that the user's level grants the permission the
+// route requires and that the token itself is allowed to access it
+func (b *Backend) wrapClaims(perm auth.Permission, allowed func(*auth.UserClaims) bool, handler http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get user credentials
 		header := r.Header.Get("Authorization")
@@ -98,11 +190,14 @@ func (b *Backend) wrapAuth(handler http.HandlerFunc) http.HandlerFunc {
 
 		token := parts[1]
 
-		claims, err := b.Auth.Verify(token)
+		claims, err := b.Auth.Verify(r.Context(), token)
 		if err != nil {
+			b.audit(r, "", audit.ActionTokenRejected, false, err.Error())
 			switch err {
 			case auth.ErrTokenExpired:
 				jsonErr(w, "authentication required", http.StatusUnauthorized)
+			case auth.ErrSessionRevoked:
+				jsonErr(w, "session revoked", http.StatusUnauthorized)
 			case auth.ErrTokenParseFailed:
 				jsonErr(w, "invalid token", http.StatusBadRequest)
 			default:
@@ -111,11 +206,32 @@ func (b *Backend) wrapAuth(handler http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
+		if !claims.Can(perm) {
+			forbidden(w)
+			return
+		}
+
+		if !allowed(claims) {
+			jsonErr(w, "token is missing the required scope", http.StatusForbidden)
+			return
+		}
+
+		err = b.Auth.TouchSession(r.Context(), claims)
+		if err != nil {
+			b.httpLogger.Warn("could not update session", zap.String("user", claims.User), zap.Error(err))
+		}
+
 		ctx := context.WithValue(r.Context(), authKey, claims)
 		handler(w, r.WithContext(ctx))
 	}
 }
 
+// apiJWKS publishes the public signing keys so that other services can verify tokens
+func (b *Backend) apiJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	jsonResponse(w, b.Auth.JWKS())
+}
+
 func (b *Backend) apiAuth(w http.ResponseWriter, r *http.Request) {
 	var authPayload api.AuthRequest
 	err := json.NewDecoder(r.Body).Decode(&authPayload)
@@ -124,27 +240,181 @@ func (b *Backend) apiAuth(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, token, err := b.Auth.Authenticate(authPayload.User, authPayload.AuthKey, jwt.StandardClaims{
-		ExpiresAt: time.Now().Add(time.Hour * 24 * 7).Unix(),
-	})
+	user, token, err := b.Auth.Authenticate(r.Context(), authPayload.User, authPayload.AuthKey, authPayload.OTP, jwt.StandardClaims{}, b.sessionInfo(r))
 
 	if err != nil {
-		if err == auth.ErrInvalidKey || err == auth.ErrUserNotFound {
+		b.audit(r, authPayload.User, audit.ActionLogin, false, err.Error())
+		switch err {
+		case auth.ErrInvalidKey, auth.ErrUserNotFound:
 			jsonErr(w, "invalid credentials", http.StatusUnauthorized)
 			return
+		case auth.ErrOTPRequired:
+			jsonErr(w, "otp required", http.StatusUnauthorized)
+			return
+		case auth.ErrInvalidOTP:
+			jsonErr(w, "invalid otp", http.StatusUnauthorized)
+			return
+		}
+		if lockout, ok := err.(*auth.LockoutError); ok {
+			tooManyAttempts(w, lockout)
+			return
 		}
 		b.httpLogger.Error("internal error while authenticating", zap.Error(err))
-		jsonErr(w, fmt.Sprintf("server error: %s", err.Error()), http.StatusInternalServerError)
+		serverError(w, err)
+		return
+	}
+
+	b.audit(r, user.User, audit.ActionLogin, true, "")
+	b.loginResponse(r.Context(), w, user, token)
+}
+
+// loginResponse sends a newly issued token to the client, along with a
+// refresh token for its session
+func (b *Backend) loginResponse(ctx context.Context, w http.ResponseWriter, user auth.UserClaims, token string) {
+	refreshToken, _, err := b.Auth.CreateRefreshToken(ctx, user)
+	if err != nil {
+		b.httpLogger.Error("internal error while creating refresh token", zap.Error(err))
+		serverError(w, err)
 		return
 	}
 
 	jsonResponse(w, api.AuthResponse{
-		Ok:    true,
-		User:  user.User,
-		Level: string(user.Level),
-		Token: token,
+		Ok:           true,
+		User:         user.User,
+		Level:        string(user.Level),
+		Token:        token,
+		ExpiresAt:    time.Unix(user.ExpiresAt, 0),
+		RefreshToken: refreshToken,
+	})
+}
+
+// Cookie holding the ID of a Twitch login, only the browser that started the
+// login has it
+const twitchLoginCookie = "stulbe_twitch_login"
+
+// apiTwitchLogin starts a login with Twitch, the browser navigates here and is
+// redirected to the authorization page. Once authorized, the page that started
+// it (same origin) completes the login with apiTwitchLoginComplete.
+func (b *Backend) apiTwitchLogin(w http.ResponseWriter, r *http.Request) {
+	login, err := b.Auth.StartTwitchLogin(r.Context())
+	if err != nil {
+		b.httpLogger.Error("internal error while starting twitch login", zap.Error(err))
+		serverError(w, err)
+		return
+	}
+
+	// Set on a top-level navigation so that it's first-party, the OAuth
+	// callback and the completion request must both come with it
+	http.SetCookie(w, &http.Cookie{
+		Name:     twitchLoginCookie,
+		Value:    login.ID,
+		Path:     "/",
+		Expires:  login.ExpiresAt,
+		Secure:   b.redirectURL.Scheme == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	uri := b.Client.GetAuthorizationURL(&helix.AuthorizationURLParams{
+		ResponseType: "code",
+		State:        login.State,
+	})
+	http.Redirect(w, r, uri, http.StatusFound)
+}
+
+func (b *Backend) clearTwitchLoginCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:   twitchLoginCookie,
+		Path:   "/",
+		MaxAge: -1,
 	})
 }
+
+func (b *Backend) apiTwitchLoginComplete(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(twitchLoginCookie)
+	if err != nil {
+		b.audit(r, "", audit.ActionLogin, false, "via twitch: missing login cookie")
+		jsonErr(w, "invalid or expired login", http.StatusUnauthorized)
+		return
+	}
+
+	// The body is optional, it's only needed for one-time codes
+	var payload api.TwitchLoginCompleteRequest
+	err = json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil && err != io.EOF {
+		jsonErr(w, fmt.Sprintf("invalid json body: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	user, token, err := b.Auth.CompleteTwitchLogin(r.Context(), cookie.Value, payload.OTP, jwt.StandardClaims{}, b.sessionInfo(r))
+	if err != nil {
+		if err != auth.ErrLoginPending {
+			b.audit(r, user.User, audit.ActionLogin, false, "via twitch: "+err.Error())
+		}
+		if lockout, ok := err.(*auth.LockoutError); ok {
+			tooManyAttempts(w, lockout)
+			return
+		}
+		switch err {
+		case auth.ErrLoginPending:
+			// Not an error, the client should keep polling
+			jsonErr(w, "login pending", http.StatusAccepted)
+		case auth.ErrInvalidLogin:
+			b.clearTwitchLoginCookie(w)
+			jsonErr(w, "invalid or expired login", http.StatusUnauthorized)
+		case auth.ErrTwitchNotAllowed, auth.ErrUserNotFound:
+			b.clearTwitchLoginCookie(w)
+			jsonErr(w, "this twitch account can't be used to log in", http.StatusForbidden)
+		case auth.ErrOTPRequired:
+			jsonErr(w, "otp required", http.StatusUnauthorized)
+		case auth.ErrInvalidOTP:
+			jsonErr(w, "invalid otp", http.StatusUnauthorized)
+		default:
+			b.httpLogger.Error("internal error while completing twitch login", zap.Error(err))
+			serverError(w, err)
+		}
+		return
+	}
+
+	b.clearTwitchLoginCookie(w)
+	b.audit(r, user.User, audit.ActionLogin, true, "via twitch")
+	b.loginResponse(r.Context(), w, user, token)
+}
+
+func (b *Backend) apiRefresh(w http.ResponseWriter, r *http.Request) {
+	var payload api.RefreshRequest
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		jsonErr(w, fmt.Sprintf("invalid json body: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	user, token, refreshToken, err := b.Auth.Refresh(r.Context(), payload.RefreshToken)
+	if err != nil {
+		b.audit(r, "", audit.ActionTokenRefresh, false, err.Error())
+		switch err {
+		case auth.ErrInvalidRefreshToken, auth.ErrUserNotFound:
+			jsonErr(w, "invalid refresh token", http.StatusUnauthorized)
+		case auth.ErrRefreshTokenReused, auth.ErrSessionRevoked:
+			jsonErr(w, "session revoked", http.StatusUnauthorized)
+		default:
+			b.httpLogger.Error("internal error while refreshing token", zap.Error(err))
+			serverError(w, err)
+		}
+		return
+	}
+
+	b.audit(r, user.User, audit.ActionTokenRefresh, true, "")
+	jsonResponse(w, api.AuthResponse{
+		Ok:           true,
+		User:         user.User,
+		Level:        string(user.Level),
+		Token:        token,
+		ExpiresAt:    time.Unix(user.ExpiresAt, 0),
+		RefreshToken: refreshToken,
+	})
+}
+
 func (b *Backend) GetChannelByID(channelid string) (string, error) {
 	channelName, ok := b.channelCache.Get(channelid)
 	if !ok {
@@ -187,10 +457,68 @@ func (b *Backend) GetUserByID(userid string) (helix.User, error) {
 	return username.(helix.User), nil
 }
 
+// clientIP returns the address of the client, proxy headers are only
+// considered if the backend is configured to trust them
+func (b *Backend) clientIP(r *http.Request) string {
+	if b.config.TrustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+		if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+			return realIP
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// audit records an event in the audit log with the client's details
+func (b *Backend) audit(r *http.Request, user string, action audit.Action, success bool, details string) {
+	b.Audit.Record(r.Context(), audit.Entry{
+		User:      user,
+		Action:    action,
+		Success:   success,
+		IP:        b.clientIP(r),
+		UserAgent: r.UserAgent(),
+		Details:   details,
+	})
+}
+
+func (b *Backend) sessionInfo(r *http.Request) auth.SessionInfo {
+	return auth.SessionInfo{
+		IP:        b.clientIP(r),
+		UserAgent: r.UserAgent(),
+	}
+}
+
 func unauthorized(w http.ResponseWriter) {
 	jsonErr(w, "authentication required", http.StatusUnauthorized)
 }
 
+func forbidden(w http.ResponseWriter) {
+	jsonErr(w, "insufficient permissions", http.StatusForbidden)
+}
+
+// serverError reports an internal error, timed out database calls are
+// reported as the service being unavailable so clients know to retry
+func serverError(w http.ResponseWriter, err error) {
+	var timeout *database.TimeoutError
+	if errors.As(err, &timeout) {
+		w.Header().Set("Retry-After", "1")
+		jsonErr(w, "database unavailable: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	jsonErr(w, fmt.Sprintf("server error: %s", err.Error()), http.StatusInternalServerError)
+}
+
+func tooManyAttempts(w http.ResponseWriter, lockout *auth.LockoutError) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(lockout.RetryAfter().Seconds()))))
+	jsonErr(w, "too many failed attempts, try again later", http.StatusTooManyRequests)
+}
+
 func jsonResponse(w http.ResponseWriter, data interface{}) error {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
@@ -0,0 +1,130 @@
+package stulbe
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+
+	"github.com/strimertul/stulbe/api"
+	"github.com/strimertul/stulbe/auth"
+)
+
+func grantInfo(grant auth.Grant) api.GrantInfo {
+	info := api.GrantInfo{
+		Owner:     grant.Owner,
+		Grantee:   grant.Grantee,
+		Read:      grant.Read,
+		Write:     grant.Write,
+		CreatedAt: grant.CreatedAt,
+	}
+	if info.Read == nil {
+		info.Read = []string{}
+	}
+	if info.Write == nil {
+		info.Write = []string{}
+	}
+	return info
+}
+
+func grantList(grants []auth.Grant) []api.GrantInfo {
+	out := make([]api.GrantInfo, len(grants))
+	for i, grant := range grants {
+		out[i] = grantInfo(grant)
+	}
+	return out
+}
+
+func (b *Backend) apiListGrants(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(authKey).(*auth.UserClaims)
+
+	grants, err := b.Auth.ListGrants(r.Context(), claims.User)
+	if err != nil {
+		b.httpLogger.Error("internal error while listing grants", zap.Error(err))
+		serverError(w, err)
+		return
+	}
+
+	jsonResponse(w, api.GrantListResponse{
+		Ok:     true,
+		Grants: grantList(grants),
+	})
+}
+
+func (b *Backend) apiListReceivedGrants(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(authKey).(*auth.UserClaims)
+
+	grants, err := b.Auth.ListReceivedGrants(r.Context(), claims.User)
+	if err != nil {
+		b.httpLogger.Error("internal error while listing grants", zap.Error(err))
+		serverError(w, err)
+		return
+	}
+
+	jsonResponse(w, api.GrantListResponse{
+		Ok:     true,
+		Grants: grantList(grants),
+	})
+}
+
+func (b *Backend) apiSetGrant(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(authKey).(*auth.UserClaims)
+	grantee := mux.Vars(r)["user"]
+
+	var payload api.GrantRequest
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		jsonErr(w, fmt.Sprintf("invalid json body: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	grant, err := b.Auth.SetGrant(r.Context(), claims.User, grantee, payload.Read, payload.Write)
+	if err != nil {
+		switch err {
+		case auth.ErrUserNotFound:
+			jsonErr(w, "user not found", http.StatusNotFound)
+		case auth.ErrInvalidGrant:
+			jsonErr(w, "a grant needs at least one prefix and can't be given to yourself", http.StatusBadRequest)
+		default:
+			b.httpLogger.Error("internal error while saving grant", zap.Error(err))
+			serverError(w, err)
+		}
+		return
+	}
+
+	b.httpLogger.Info("granted namespace access", zap.String("owner", claims.User), zap.String("grantee", grantee))
+	jsonResponse(w, api.GrantResponse{
+		Ok:    true,
+		Grant: grantInfo(grant),
+	})
+}
+
+func (b *Backend) apiRevokeGrant(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(authKey).(*auth.UserClaims)
+	b.revokeGrant(r.Context(), w, claims.User, mux.Vars(r)["user"])
+}
+
+// apiDropGrant lets a user give up access to someone else's namespace
+func (b *Backend) apiDropGrant(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(authKey).(*auth.UserClaims)
+	b.revokeGrant(r.Context(), w, mux.Vars(r)["owner"], claims.User)
+}
+
+func (b *Backend) revokeGrant(ctx context.Context, w http.ResponseWriter, owner string, grantee string) {
+	err := b.Auth.RevokeGrant(ctx, owner, grantee)
+	if err != nil {
+		if err == auth.ErrGrantNotFound {
+			jsonErr(w, "grant not found", http.StatusNotFound)
+			return
+		}
+		b.httpLogger.Error("internal error while revoking grant", zap.Error(err))
+		serverError(w, err)
+		return
+	}
+
+	b.httpLogger.Info("revoked namespace access", zap.String("owner", owner), zap.String("grantee", grantee))
+	jsonResponse(w, api.StatusResponse{Ok: true})
+}
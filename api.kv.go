@@ -0,0 +1,221 @@
+package stulbe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/strimertul/stulbe/api"
+	"github.com/strimertul/stulbe/archive"
+	"github.com/strimertul/stulbe/audit"
+	"github.com/strimertul/stulbe/auth"
+)
+
+// Maximum size of archives accepted by the import endpoint
+const maxImportSize = 64 << 20
+
+var (
+	errNoNamespace       = errors.New("no namespace access")
+	errScopedDelegation  = errors.New("api keys can't access other namespaces")
+	errForbiddenKeyWrite = errors.New("token can't write this key")
+)
+
+// resolveNamespace returns the namespace owner a request is for (the user
+// itself if empty) and the claims to authorize its keys with. Access to other
+// users' namespaces is limited to the prefixes the owner granted.
+func (b *Backend) resolveNamespace(ctx context.Context, claims *auth.UserClaims, namespace string) (string, *auth.UserClaims, error) {
+	if namespace == "" || namespace == claims.User {
+		if !claims.Can(auth.PermNamespace) {
+			return claims.User, claims, errNoNamespace
+		}
+		return claims.User, claims, nil
+	}
+
+	// Delegated access, only allowed for full access tokens of users
+	// the namespace owner gave a grant to
+	if claims.Scoped() {
+		return namespace, claims, errScopedDelegation
+	}
+	grant, err := b.Auth.GetGrant(ctx, namespace, claims.User)
+	if err != nil {
+		return namespace, claims, err
+	}
+	return namespace, grant.Claims(claims), nil
+}
+
+// namespaceError replies to requests that failed resolveNamespace
+func (b *Backend) namespaceError(w http.ResponseWriter, err error) {
+	switch err {
+	case errNoNamespace, auth.ErrGrantNotFound, errForbiddenKeyWrite:
+		forbidden(w)
+	case errScopedDelegation:
+		jsonErr(w, err.Error(), http.StatusForbidden)
+	default:
+		b.httpLogger.Error("internal error while looking up grant", zap.Error(err))
+		serverError(w, err)
+	}
+}
+
+func (b *Backend) apiKVDeleteKey(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	key := query.Get("key")
+	if key == "" {
+		jsonErr(w, "missing key", http.StatusBadRequest)
+		return
+	}
+
+	namespace, claims, err := b.resolveNamespace(r.Context(), r.Context().Value(authKey).(*auth.UserClaims), query.Get("namespace"))
+	if err == nil && !claims.CanWrite(key) {
+		err = errForbiddenKeyWrite
+	}
+	if err != nil {
+		b.namespaceError(w, err)
+		return
+	}
+
+	err = b.DB.RemoveKey(r.Context(), UserNamespace(namespace)+key)
+	if err != nil {
+		b.httpLogger.Error("internal error while removing key", zap.Error(err))
+		serverError(w, err)
+		return
+	}
+
+	jsonResponse(w, api.KVDeleteResponse{
+		Ok:      true,
+		Removed: 1,
+	})
+}
+
+func (b *Backend) apiKVDeletePrefix(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	// Require a prefix so that a missing parameter doesn't wipe the whole namespace
+	prefix := query.Get("prefix")
+	if prefix == "" {
+		jsonErr(w, "missing prefix", http.StatusBadRequest)
+		return
+	}
+
+	namespace, claims, err := b.resolveNamespace(r.Context(), r.Context().Value(authKey).(*auth.UserClaims), query.Get("namespace"))
+	if err == nil && !claims.CanWrite(prefix) {
+		err = errForbiddenKeyWrite
+	}
+	if err != nil {
+		b.namespaceError(w, err)
+		return
+	}
+
+	removed, err := b.DB.RemoveAll(r.Context(), UserNamespace(namespace)+prefix)
+	if err != nil {
+		b.httpLogger.Error("internal error while removing keys", zap.Error(err))
+		serverError(w, err)
+		return
+	}
+
+	b.httpLogger.Info("removed keys", zap.String("namespace", namespace), zap.String("prefix", prefix), zap.Int("removed", removed))
+	jsonResponse(w, api.KVDeleteResponse{
+		Ok:      true,
+		Removed: removed,
+	})
+}
+
+func (b *Backend) apiKVExport(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	format := archive.Format(query.Get("format"))
+	if format == "" {
+		format = archive.FormatJSON
+	}
+	if !archive.ValidFormat(format) {
+		jsonErr(w, "format must be json or ndjson", http.StatusBadRequest)
+		return
+	}
+
+	namespace, claims, err := b.resolveNamespace(r.Context(), r.Context().Value(authKey).(*auth.UserClaims), query.Get("namespace"))
+	if err != nil {
+		b.namespaceError(w, err)
+		return
+	}
+
+	// Nothing is written until all keys have been read, so errors can still
+	// be replied to normally, after that the archive is streamed as it goes
+	contentType := "application/json"
+	if format == archive.FormatNDJSON {
+		contentType = "application/x-ndjson"
+	}
+	w.Header().Set("Content-Type", contentType+"; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.%s"`, namespace, time.Now().Format("20060102-150405"), format))
+	count, err := archive.Export(r.Context(), b.DB, w, format, namespace, UserNamespace(namespace), claims.CanRead)
+	if err != nil {
+		b.httpLogger.Error("internal error while exporting namespace", zap.Error(err), zap.String("namespace", namespace))
+		if count == 0 {
+			w.Header().Del("Content-Disposition")
+			serverError(w, err)
+		}
+		return
+	}
+
+	b.audit(r, claims.User, audit.ActionNamespaceExport, true, fmt.Sprintf("namespace %s, %d keys", namespace, count))
+}
+
+func (b *Backend) apiKVImport(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	options := archive.ImportOptions{
+		Mode: archive.Mode(query.Get("mode")),
+	}
+	if options.Mode == "" {
+		options.Mode = archive.ModeMerge
+	}
+	if options.Mode != archive.ModeMerge && options.Mode != archive.ModeReplace {
+		jsonErr(w, "mode must be merge or replace", http.StatusBadRequest)
+		return
+	}
+	if dryRun := query.Get("dry_run"); dryRun != "" {
+		var err error
+		options.DryRun, err = strconv.ParseBool(dryRun)
+		if err != nil {
+			jsonErr(w, "invalid dry_run value", http.StatusBadRequest)
+			return
+		}
+	}
+
+	namespace, claims, err := b.resolveNamespace(r.Context(), r.Context().Value(authKey).(*auth.UserClaims), query.Get("namespace"))
+	if err != nil {
+		b.namespaceError(w, err)
+		return
+	}
+	options.Filter = claims.CanWrite
+
+	data, err := archive.Read(http.MaxBytesReader(w, r.Body, maxImportSize))
+	if err != nil {
+		jsonErr(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := archive.Import(r.Context(), b.DB, UserNamespace(namespace), data, options)
+	if err != nil {
+		if err == archive.ErrForbiddenKey {
+			jsonErr(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		b.audit(r, claims.User, audit.ActionNamespaceImport, false, fmt.Sprintf("namespace %s: %s", namespace, err.Error()))
+		b.httpLogger.Error("internal error while importing namespace", zap.Error(err), zap.String("namespace", namespace))
+		serverError(w, err)
+		return
+	}
+
+	if !options.DryRun {
+		b.audit(r, claims.User, audit.ActionNamespaceImport, true, fmt.Sprintf("namespace %s, %s: %d added, %d updated, %d removed", namespace, options.Mode, result.Added, result.Updated, result.Removed))
+	}
+	jsonResponse(w, api.KVImportResponse{
+		Ok:        true,
+		DryRun:    options.DryRun,
+		Added:     result.Added,
+		Updated:   result.Updated,
+		Unchanged: result.Unchanged,
+		Removed:   result.Removed,
+	})
+}
@@ -0,0 +1,85 @@
+package stulbe
+
+import (
+	"context"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/strimertul/stulbe/auth"
+	"github.com/strimertul/stulbe/internal/dbtest"
+)
+
+func TestResolveNamespace(t *testing.T) {
+	ctx := context.Background()
+	store, err := auth.Init(ctx, dbtest.New(t), auth.Options{Logger: zap.NewNop()})
+	if err != nil {
+		t.Fatalf("could not create auth storage: %s", err)
+	}
+	b := &Backend{Auth: store}
+
+	users := map[string]auth.UserLevel{
+		"streamer": auth.ULStreamer,
+		"mod":      auth.ULModerator,
+		"other":    auth.ULStreamer,
+	}
+	for user, level := range users {
+		if err := store.CreateUser(ctx, user, "password", level); err != nil {
+			t.Fatalf("creating user: %s", err)
+		}
+	}
+	if _, err := store.SetGrant(ctx, "streamer", "mod", []string{"overlay/"}, []string{"chat/"}); err != nil {
+		t.Fatalf("setting grant: %s", err)
+	}
+
+	streamer := &auth.UserClaims{User: "streamer", Level: auth.ULStreamer}
+	streamerKey := &auth.UserClaims{User: "streamer", Level: auth.ULStreamer, Scopes: []string{auth.ScopeKVReadPrefix + "overlay/"}}
+	mod := &auth.UserClaims{User: "mod", Level: auth.ULModerator}
+	modKey := &auth.UserClaims{User: "mod", Level: auth.ULModerator, Scopes: []string{auth.ScopeKVReadPrefix + "overlay/"}}
+	other := &auth.UserClaims{User: "other", Level: auth.ULStreamer}
+
+	tests := []struct {
+		name      string
+		claims    *auth.UserClaims
+		namespace string
+		owner     string
+		err       error
+		canRead   string
+		cantRead  string
+		canWrite  string
+	}{
+		{"own namespace", streamer, "", "streamer", nil, "secret", "", "secret"},
+		{"own namespace by name", streamer, "streamer", "streamer", nil, "secret", "", "secret"},
+		{"own namespace with api key", streamerKey, "", "streamer", nil, "overlay/title", "secret", ""},
+		{"level without namespace", mod, "", "mod", errNoNamespace, "", "", ""},
+		{"granted namespace", mod, "streamer", "streamer", nil, "overlay/title", "secret", "chat/last"},
+		{"granted namespace with api key", modKey, "streamer", "streamer", errScopedDelegation, "", "", ""},
+		{"namespace without grant", other, "streamer", "streamer", auth.ErrGrantNotFound, "", "", ""},
+		{"grants only go one way", streamer, "mod", "mod", auth.ErrGrantNotFound, "", "", ""},
+	}
+	for _, test := range tests {
+		owner, claims, err := b.resolveNamespace(ctx, test.claims, test.namespace)
+		if err != test.err {
+			t.Errorf("%s: expected error %v, got %v", test.name, test.err, err)
+			continue
+		}
+		if owner != test.owner {
+			t.Errorf("%s: expected namespace of %s, got %s", test.name, test.owner, owner)
+		}
+		if err != nil {
+			continue
+		}
+		if claims.User != test.claims.User {
+			t.Errorf("%s: expected claims of %s, got %s", test.name, test.claims.User, claims.User)
+		}
+		if test.canRead != "" && !claims.CanRead(test.canRead) {
+			t.Errorf("%s: expected %s to be readable", test.name, test.canRead)
+		}
+		if test.cantRead != "" && claims.CanRead(test.cantRead) {
+			t.Errorf("%s: expected %s not to be readable", test.name, test.cantRead)
+		}
+		if test.canWrite != "" && !claims.CanWrite(test.canWrite) {
+			t.Errorf("%s: expected %s to be writable", test.name, test.canWrite)
+		}
+	}
+}
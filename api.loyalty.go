@@ -65,10 +65,10 @@ func (b *Backend) apiLoyaltyConfig(w http.ResponseWriter, r *http.Request) {
 		jsonErr(w, "error fetching channel data: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	configKey := userNamespace(channel) + loyaltyConfigKey
+	configKey := UserNamespace(channel) + loyaltyConfigKey
 
 	data := loyaltyConfig{}
-	err = b.DB.GetJSON(configKey, &data)
+	err = b.DB.GetJSON(r.Context(), configKey, &data)
 	if err != nil && err != kv.ErrorKeyNotFound {
 		jsonErr(w, "error fetching data: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -91,10 +91,10 @@ func (b *Backend) apiLoyaltyRewards(w http.ResponseWriter, r *http.Request) {
 		jsonErr(w, "error fetching channel data: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	rewardKey := userNamespace(channel) + loyaltyRewardsKey
+	rewardKey := UserNamespace(channel) + loyaltyRewardsKey
 
 	data := loyaltyRewardStorage{}
-	err = b.DB.GetJSON(rewardKey, &data)
+	err = b.DB.GetJSON(r.Context(), rewardKey, &data)
 	if err != nil && err != kv.ErrorKeyNotFound {
 		jsonErr(w, "error fetching data: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -111,10 +111,10 @@ func (b *Backend) apiLoyaltyGoals(w http.ResponseWriter, r *http.Request) {
 		jsonErr(w, "error fetching channel data: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	goalKey := userNamespace(channel) + loyaltyGoalsKey
+	goalKey := UserNamespace(channel) + loyaltyGoalsKey
 
 	data := loyaltyGoalStorage{}
-	err = b.DB.GetJSON(goalKey, &data)
+	err = b.DB.GetJSON(r.Context(), goalKey, &data)
 	if err != nil && err != kv.ErrorKeyNotFound {
 		jsonErr(w, "error fetching data: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -143,9 +143,9 @@ func (b *Backend) apiLoyaltyUserData(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	pointsKey := userNamespace(channel) + loyaltyPointsPrefix + user.Login
+	pointsKey := UserNamespace(channel) + loyaltyPointsPrefix + user.Login
 	var data loyaltyPointsEntry
-	err = b.DB.GetJSON(pointsKey, &data)
+	err = b.DB.GetJSON(r.Context(), pointsKey, &data)
 	if err != nil {
 		if err != kv.ErrorKeyNotFound {
 			jsonErr(w, "error fetching points: "+err.Error(), http.StatusInternalServerError)
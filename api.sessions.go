@@ -0,0 +1,185 @@
+package stulbe
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+
+	"github.com/strimertul/stulbe/api"
+	"github.com/strimertul/stulbe/auth"
+)
+
+const (
+	apiKeyDefaultLifetime = time.Hour * 24 * 30
+	apiKeyMaxLifetime     = time.Hour * 24 * 365
+)
+
+func sessionList(sessions []auth.Session, current string) []api.SessionInfo {
+	out := make([]api.SessionInfo, len(sessions))
+	for i, session := range sessions {
+		out[i] = api.SessionInfo{
+			ID:        session.ID,
+			IP:        session.IP,
+			UserAgent: session.UserAgent,
+			CreatedAt: session.CreatedAt,
+			LastSeen:  session.LastSeen,
+			ExpiresAt: session.ExpiresAt,
+			Current:   session.ID == current,
+			Name:      session.Name,
+			Scopes:    session.Scopes,
+		}
+	}
+	return out
+}
+
+func (b *Backend) apiListSessions(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(authKey).(*auth.UserClaims)
+
+	sessions, err := b.Auth.ListSessions(r.Context(), claims.User)
+	if err != nil {
+		b.httpLogger.Error("internal error while listing sessions", zap.Error(err))
+		serverError(w, err)
+		return
+	}
+
+	jsonResponse(w, api.SessionListResponse{
+		Ok:       true,
+		Sessions: sessionList(sessions, claims.Id),
+	})
+}
+
+func (b *Backend) apiRevokeSession(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(authKey).(*auth.UserClaims)
+	b.revokeSession(r.Context(), w, claims.User, mux.Vars(r)["id"])
+}
+
+func (b *Backend) apiListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(authKey).(*auth.UserClaims)
+
+	sessions, err := b.Auth.ListSessions(r.Context(), claims.User)
+	if err != nil {
+		b.httpLogger.Error("internal error while listing sessions", zap.Error(err))
+		serverError(w, err)
+		return
+	}
+
+	keys := []auth.Session{}
+	for _, session := range sessions {
+		if session.APIKey() {
+			keys = append(keys, session)
+		}
+	}
+
+	jsonResponse(w, api.SessionListResponse{
+		Ok:       true,
+		Sessions: sessionList(keys, claims.Id),
+	})
+}
+
+func (b *Backend) apiCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(authKey).(*auth.UserClaims)
+
+	var payload api.APIKeyCreateRequest
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		jsonErr(w, fmt.Sprintf("invalid json body: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	if payload.Name == "" {
+		jsonErr(w, "missing name", http.StatusBadRequest)
+		return
+	}
+	lifetime := apiKeyDefaultLifetime
+	if payload.ExpiresIn != "" {
+		lifetime, err = time.ParseDuration(payload.ExpiresIn)
+		if err != nil || lifetime <= 0 || lifetime > apiKeyMaxLifetime {
+			jsonErr(w, "invalid expiration", http.StatusBadRequest)
+			return
+		}
+	}
+
+	session, token, err := b.Auth.CreateAPIKey(r.Context(), claims.User, payload.Name, payload.Scopes, time.Now().Add(lifetime), b.sessionInfo(r))
+	if err != nil {
+		if err == auth.ErrInvalidScope {
+			jsonErr(w, "invalid or missing scopes", http.StatusBadRequest)
+			return
+		}
+		b.httpLogger.Error("internal error while creating api key", zap.Error(err))
+		serverError(w, err)
+		return
+	}
+
+	b.httpLogger.Info("created api key", zap.String("user", claims.User), zap.String("name", session.Name), zap.Strings("scopes", session.Scopes))
+	jsonResponse(w, api.APIKeyCreateResponse{
+		Ok:    true,
+		Key:   sessionList([]auth.Session{session}, "")[0],
+		Token: token,
+	})
+}
+
+func (b *Backend) apiAdminListSessions(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["user"]
+	if _, ok := b.Auth.GetUser(username); !ok {
+		jsonErr(w, "user not found", http.StatusNotFound)
+		return
+	}
+
+	sessions, err := b.Auth.ListSessions(r.Context(), username)
+	if err != nil {
+		b.httpLogger.Error("internal error while listing sessions", zap.Error(err))
+		serverError(w, err)
+		return
+	}
+
+	jsonResponse(w, api.SessionListResponse{
+		Ok:       true,
+		Sessions: sessionList(sessions, ""),
+	})
+}
+
+func (b *Backend) apiAdminRevokeSession(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	b.revokeSession(r.Context(), w, vars["user"], vars["id"])
+}
+
+func (b *Backend) apiAdminRevokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["user"]
+
+	revoked, err := b.Auth.RevokeAllSessions(r.Context(), username)
+	if err != nil {
+		b.httpLogger.Error("internal error while revoking sessions", zap.Error(err))
+		serverError(w, err)
+		return
+	}
+
+	b.httpLogger.Info("revoked all sessions", zap.String("user", username), zap.Int("revoked", revoked))
+	jsonResponse(w, api.SessionRevokeResponse{
+		Ok:      true,
+		Revoked: revoked,
+	})
+}
+
+func (b *Backend) revokeSession(ctx context.Context, w http.ResponseWriter, user string, id string) {
+	err := b.Auth.RevokeSession(ctx, user, id)
+	if err != nil {
+		if err == auth.ErrSessionNotFound {
+			jsonErr(w, "session not found", http.StatusNotFound)
+			return
+		}
+		b.httpLogger.Error("internal error while revoking session", zap.Error(err))
+		serverError(w, err)
+		return
+	}
+
+	b.httpLogger.Info("revoked session", zap.String("user", user), zap.String("session", id))
+	jsonResponse(w, api.SessionRevokeResponse{
+		Ok:      true,
+		Revoked: 1,
+	})
+}
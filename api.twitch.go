@@ -1,6 +1,7 @@
 package stulbe
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -15,6 +16,7 @@ import (
 	"github.com/nicklaw5/helix/v2"
 
 	kv "github.com/strimertul/kilovolt/v8"
+	"github.com/strimertul/stulbe/audit"
 	"github.com/strimertul/stulbe/auth"
 )
 
@@ -23,11 +25,23 @@ func (b Backend) apiTwitchAuthRedirect(w http.ResponseWriter, req *http.Request)
 	claims, ok := req.Context().Value(authKey).(*auth.UserClaims)
 	if !ok {
 		jsonErr(w, "authorization required", http.StatusUnauthorized)
+		return
+	}
+
+	// The state nonce tells the callback which user is linking their account
+	state, err := b.Auth.CreateOAuthState(req.Context(), auth.OAuthState{
+		Purpose: auth.OAuthLink,
+		User:    claims.User,
+	})
+	if err != nil {
+		b.httpLogger.Error("internal error while creating oauth state", zap.Error(err))
+		serverError(w, err)
+		return
 	}
 
 	uri := b.Client.GetAuthorizationURL(&helix.AuthorizationURLParams{
 		ResponseType: "code",
-		State:        claims.User,
+		State:        state,
 		Scopes:       []string{"bits:read channel:read:subscriptions channel:read:redemptions channel:read:polls channel:read:predictions channel:read:hype_train user_read"},
 	})
 	jsonResponse(w, struct {
@@ -44,18 +58,47 @@ type AuthResponse struct {
 	ExpiresIn    int      `json:"expires_in"`
 	Scope        []string `json:"scope"`
 	Time         time.Time
+	// ID of the Twitch user the tokens are for, missing in records saved by older versions
+	UserID string `json:"user_id,omitempty"`
 }
 
 const authKeysPrefix = "@twitch-auth/"
 
 func (b *Backend) authorizeCallback(w http.ResponseWriter, req *http.Request) {
+	user := ""
+	action := audit.ActionTwitchAuthorize
+	failed := func(message string, code int) {
+		b.audit(req, user, action, false, message)
+		jsonErr(w, message, code)
+	}
+
+	state, err := b.Auth.ConsumeOAuthState(req.Context(), req.URL.Query().Get("state"))
+	if err != nil {
+		if err == auth.ErrInvalidOAuthState {
+			failed("invalid or expired state", http.StatusBadRequest)
+			return
+		}
+		failed("failed checking state: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	user = state.User
+	if state.Purpose == auth.OAuthLogin {
+		action = audit.ActionTwitchLogin
+
+		// Only the browser that started the login can finish it
+		cookie, err := req.Cookie(twitchLoginCookie)
+		if err != nil || !state.BoundTo(cookie.Value) {
+			failed(auth.ErrLoginNotBound.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
 	// Get code from params
 	code := req.URL.Query().Get("code")
 	if code == "" {
-		jsonErr(w, "missing code", http.StatusBadRequest)
+		failed("missing code", http.StatusBadRequest)
 		return
 	}
-	state := req.URL.Query().Get("state")
 	// Exchange code for access/refresh tokens
 	query := url.Values{
 		"client_id":     {b.config.Twitch.ClientID},
@@ -66,27 +109,22 @@ func (b *Backend) authorizeCallback(w http.ResponseWriter, req *http.Request) {
 	}
 	authRequest, err := http.NewRequest("POST", "https://id.twitch.tv/oauth2/token?"+query.Encode(), nil)
 	if err != nil {
-		jsonErr(w, "failed creating auth request: "+err.Error(), http.StatusInternalServerError)
+		failed("failed creating auth request: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 	resp, err := http.DefaultClient.Do(authRequest)
 	if err != nil {
-		jsonErr(w, "failed sending auth request: "+err.Error(), http.StatusInternalServerError)
+		failed("failed sending auth request: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer resp.Body.Close()
 	var authResp AuthResponse
 	err = jsoniter.ConfigFastest.NewDecoder(resp.Body).Decode(&authResp)
 	if err != nil && err != io.EOF {
-		jsonErr(w, "failed reading auth response: "+err.Error(), http.StatusInternalServerError)
+		failed("failed reading auth response: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 	authResp.Time = time.Now()
-	err = b.DB.PutJSON(authKeysPrefix+state, authResp)
-	if err != nil {
-		jsonErr(w, "error saving auth data for user: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
 	// Subscribe to alerts
 	client, err := helix.NewClient(&helix.Options{
 		ClientID:        b.config.Twitch.ClientID,
@@ -94,25 +132,58 @@ func (b *Backend) authorizeCallback(w http.ResponseWriter, req *http.Request) {
 		UserAccessToken: authResp.AccessToken,
 	})
 	if err != nil {
-		jsonErr(w, "failed creating user client: "+err.Error(), http.StatusInternalServerError)
+		failed("failed creating user client: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 	users, err := client.GetUsers(&helix.UsersParams{})
 	if err != nil {
-		jsonErr(w, "failed looking up user: "+err.Error(), http.StatusInternalServerError)
+		failed("failed looking up user: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	if len(users.Data.Users) < 1 {
-		jsonErr(w, "no users found", http.StatusInternalServerError)
+		failed("no users found", http.StatusInternalServerError)
 		return
 	}
-	user := users.Data.Users[0]
-	_, err = b.ensureAlertSubscription(user.ID, state)
+	twitchUser := users.Data.Users[0]
+
+	if state.Purpose == auth.OAuthLogin {
+		// Login only needs to know who the Twitch user is, tokens are not kept
+		user, err = b.Auth.FinishTwitchLogin(req.Context(), state.LoginKey, twitchUser.ID)
+		if err != nil {
+			switch err {
+			case auth.ErrTwitchNotAllowed:
+				failed("this twitch account can't be used to log in", http.StatusForbidden)
+			case auth.ErrInvalidLogin:
+				failed("invalid or expired login", http.StatusBadRequest)
+			default:
+				failed("failed completing login: "+err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		b.audit(req, user, action, true, "twitch user "+twitchUser.ID)
+		w.Header().Add("Content-Type", "text/html")
+		fmt.Fprintf(w, `<html><body><h2>All done, you can close me now!</h2><script>window.close();</script></body></html>`)
+		return
+	}
+
+	authResp.UserID = twitchUser.ID
+	err = b.DB.PutJSON(req.Context(), authKeysPrefix+user, authResp)
+	if err != nil {
+		failed("error saving auth data for user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = b.Auth.LinkTwitch(req.Context(), user, twitchUser.ID)
+	if err != nil {
+		failed("error linking twitch account: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = b.ensureAlertSubscription(twitchUser.ID, user)
 	if err != nil {
-		jsonErr(w, "failed subscribing to alerts: "+err.Error(), http.StatusInternalServerError)
+		failed("failed subscribing to alerts: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	b.audit(req, user, action, true, "twitch user "+twitchUser.ID)
 	w.Header().Add("Content-Type", "text/html")
 	fmt.Fprintf(w, `<html><body><h2>All done, you can close me now!</h2><script>window.close();</script></body></html>`)
 }
@@ -270,11 +341,16 @@ func (b *Backend) getUserClient(req *http.Request) (*helix.Client, error) {
 
 	// Get user's access token
 	var tokens AuthResponse
-	err := b.DB.GetJSON(authKeysPrefix+claims.User, &tokens)
+	err := b.DB.GetJSON(req.Context(), authKeysPrefix+claims.User, &tokens)
 	if err != nil {
 		return nil, err
 	}
 
+	return b.twitchClient(req.Context(), claims.User, tokens)
+}
+
+// twitchClient creates a client for a user's Twitch tokens, refreshing them if needed
+func (b *Backend) twitchClient(ctx context.Context, user string, tokens AuthResponse) (*helix.Client, error) {
 	// Handle token expiration
 	if time.Now().After(tokens.Time.Add(time.Duration(tokens.ExpiresIn) * time.Second)) {
 		// Refresh tokens
@@ -286,7 +362,7 @@ func (b *Backend) getUserClient(req *http.Request) (*helix.Client, error) {
 		tokens.RefreshToken = refreshed.RefreshToken
 
 		// Save new token pair
-		err = b.DB.PutJSON(authKeysPrefix+claims.User, tokens)
+		err = b.DB.PutJSON(ctx, authKeysPrefix+user, tokens)
 		if err != nil {
 			return nil, err
 		}
@@ -300,6 +376,21 @@ func (b *Backend) getUserClient(req *http.Request) (*helix.Client, error) {
 	})
 }
 
+// twitchUserID returns whether a user linked a Twitch account and the ID
+// stored for it when it was linked. Accounts linked before IDs were stored
+// have an empty ID until they are linked again.
+func (b *Backend) twitchUserID(ctx context.Context, user string) (bool, string, error) {
+	var tokens AuthResponse
+	err := b.DB.GetJSON(ctx, authKeysPrefix+user, &tokens)
+	if err != nil {
+		if err == kv.ErrorKeyNotFound {
+			return false, "", nil
+		}
+		return false, "", err
+	}
+	return true, tokens.UserID, nil
+}
+
 func (b *Backend) apiTwitchUserData(w http.ResponseWriter, req *http.Request) {
 	client, err := b.getUserClient(req)
 	if err != nil {
@@ -323,10 +414,6 @@ func (b *Backend) apiTwitchUserData(w http.ResponseWriter, req *http.Request) {
 }
 
 func (b *Backend) apiTwitchListSubscriptions(w http.ResponseWriter, req *http.Request) {
-	claims := req.Context().Value(authKey).(*auth.UserClaims)
-	if claims.Level != auth.ULAdmin {
-		jsonErr(w, "unauthorized", http.StatusUnauthorized)
-	}
 	subs, err := b.Client.GetEventSubSubscriptions(&helix.EventSubSubscriptionsParams{})
 	if err != nil {
 		jsonErr(w, "failed getting subscriptions: "+err.Error(), http.StatusInternalServerError)
@@ -341,16 +428,14 @@ func (b *Backend) apiTwitchListSubscriptions(w http.ResponseWriter, req *http.Re
 
 func (b *Backend) apiTwitchClearSubscriptions(w http.ResponseWriter, req *http.Request) {
 	claims := req.Context().Value(authKey).(*auth.UserClaims)
-	if claims.Level != auth.ULAdmin {
-		jsonErr(w, "unauthorized", http.StatusUnauthorized)
-		return
-	}
 
 	deleted, err := b.ClearSubscriptions(claims.User)
 	if err != nil {
+		b.audit(req, claims.User, audit.ActionTwitchClearSubscriptions, false, err.Error())
 		jsonErr(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	b.audit(req, claims.User, audit.ActionTwitchClearSubscriptions, true, fmt.Sprintf("deleted %d subscriptions", deleted))
 
 	jsonResponse(w, struct {
 		Ok      bool `json:"ok"`
@@ -1,5 +1,7 @@
 package api
 
+import "time"
+
 type StatusResponse struct {
 	Ok bool `json:"ok"`
 }
@@ -12,13 +14,315 @@ type ResponseError struct {
 type AuthRequest struct {
 	User    string `json:"user"`
 	AuthKey string `json:"key"`
+	// One-time code (or recovery code), required if the user has TOTP enabled
+	OTP string `json:"otp,omitempty"`
 }
 
 type AuthResponse struct {
+	Ok           bool      `json:"ok"`
+	User         string    `json:"username"`
+	Level        string    `json:"level"`
+	Token        string    `json:"token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+}
+
+type MeResponse struct {
+	Ok          bool      `json:"ok"`
+	User        string    `json:"user"`
+	Level       string    `json:"level"`
+	Permissions []string  `json:"permissions"`
+	Scopes      []string  `json:"scopes,omitempty"`
+	SessionID   string    `json:"session"`
+	IssuedAt    time.Time `json:"issued_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+
+	TwitchLinked bool   `json:"twitch_linked"`
+	TwitchUserID string `json:"twitch_user_id,omitempty"`
+}
+
+type TwitchLoginCompleteRequest struct {
+	// One-time code, required if the user has TOTP enabled
+	OTP string `json:"otp,omitempty"`
+}
+
+type TwitchAllowedInfo struct {
+	TwitchID  string    `json:"twitch_id"`
+	User      string    `json:"user"`
+	Level     string    `json:"level"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type TwitchAllowlistResponse struct {
+	Ok    bool                `json:"ok"`
+	Users []TwitchAllowedInfo `json:"users"`
+}
+
+type TwitchAllowRequest struct {
+	User string `json:"user"`
+	// Level of the user if it needs to be created, defaults to streamer
+	Level string `json:"level"`
+}
+
+type TwitchAllowResponse struct {
+	Ok   bool              `json:"ok"`
+	User TwitchAllowedInfo `json:"user"`
+}
+
+type KVDeleteResponse struct {
+	Ok      bool `json:"ok"`
+	Removed int  `json:"removed"`
+}
+
+type KVImportResponse struct {
+	Ok        bool `json:"ok"`
+	DryRun    bool `json:"dry_run"`
+	Added     int  `json:"added"`
+	Updated   int  `json:"updated"`
+	Unchanged int  `json:"unchanged"`
+	Removed   int  `json:"removed"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type UserInfo struct {
+	User  string `json:"user"`
+	Level string `json:"level"`
+	TOTP  bool   `json:"totp"`
+}
+
+type AdminUserListResponse struct {
+	Ok    bool       `json:"ok"`
+	Users []UserInfo `json:"users"`
+}
+
+type AdminUserCreateRequest struct {
+	User    string `json:"user"`
+	AuthKey string `json:"key"`
+	Level   string `json:"level"`
+}
+
+type AdminUserLevelRequest struct {
+	Level string `json:"level"`
+}
+
+type AdminUserKeyRequest struct {
+	AuthKey string `json:"key"`
+}
+
+type AdminUserKeyResponse struct {
+	Ok      bool   `json:"ok"`
+	User    string `json:"user"`
+	Level   string `json:"level"`
+	AuthKey string `json:"key"`
+}
+
+type SessionInfo struct {
+	ID        string    `json:"id"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Current   bool      `json:"current"`
+	Name      string    `json:"name,omitempty"`
+	Scopes    []string  `json:"scopes,omitempty"`
+}
+
+type SessionListResponse struct {
+	Ok       bool          `json:"ok"`
+	Sessions []SessionInfo `json:"sessions"`
+}
+
+type APIKeyCreateRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// Go duration string (eg. "720h"), defaults to 30 days
+	ExpiresIn string `json:"expires_in"`
+}
+
+type APIKeyCreateResponse struct {
+	Ok    bool        `json:"ok"`
+	Key   SessionInfo `json:"key"`
+	Token string      `json:"token"`
+}
+
+type SessionRevokeResponse struct {
+	Ok      bool `json:"ok"`
+	Revoked int  `json:"revoked"`
+}
+
+type BackupInfo struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type BackupListResponse struct {
+	Ok      bool         `json:"ok"`
+	Backups []BackupInfo `json:"backups"`
+}
+
+type BackupResponse struct {
+	Ok     bool       `json:"ok"`
+	Backup BackupInfo `json:"backup"`
+	// Can be used with "stulbe backup -since" for incremental backups on top of this one
+	Version uint64 `json:"version"`
+}
+
+type SigningKeyInfo struct {
+	ID        string     `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	RetiresAt *time.Time `json:"retires_at,omitempty"`
+	Active    bool       `json:"active"`
+}
+
+type SigningKeyListResponse struct {
+	Ok   bool             `json:"ok"`
+	Keys []SigningKeyInfo `json:"keys"`
+}
+
+type SigningKeyRotateRequest struct {
+	// Go duration string (eg. "168h"), defaults to the token lifetime
+	Grace string `json:"grace"`
+}
+
+type LockoutInfo struct {
+	Kind        string    `json:"kind"`
+	ID          string    `json:"id"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	LockedUntil time.Time `json:"locked_until"`
+	Locked      bool      `json:"locked"`
+}
+
+type LockoutListResponse struct {
+	Ok       bool          `json:"ok"`
+	Lockouts []LockoutInfo `json:"lockouts"`
+}
+
+type WebsocketTicketResponse struct {
+	Ok        bool      `json:"ok"`
+	Ticket    string    `json:"ticket"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type ChangeKeyRequest struct {
+	OldKey string `json:"old_key"`
+	NewKey string `json:"new_key"`
+}
+
+type ResetKeyRequest struct {
+	Token  string `json:"token"`
+	NewKey string `json:"new_key"`
+}
+
+type ResetTokenRequest struct {
+	// Go duration string (eg. "24h"), defaults to 24 hours
+	ExpiresIn string `json:"expires_in"`
+}
+
+type ResetTokenResponse struct {
+	Ok        bool      `json:"ok"`
+	User      string    `json:"user"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type InviteInfo struct {
+	ID        string    `json:"id"`
+	CreatedBy string    `json:"created_by"`
+	Note      string    `json:"note,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type InviteListResponse struct {
+	Ok      bool         `json:"ok"`
+	Invites []InviteInfo `json:"invites"`
+}
+
+type InviteCreateRequest struct {
+	Note string `json:"note"`
+	// Go duration string (eg. "168h"), defaults to 7 days
+	ExpiresIn string `json:"expires_in"`
+}
+
+type InviteCreateResponse struct {
+	Ok     bool       `json:"ok"`
+	Invite InviteInfo `json:"invite"`
+	Code   string     `json:"code"`
+}
+
+type GrantInfo struct {
+	Owner     string    `json:"owner"`
+	Grantee   string    `json:"grantee"`
+	Read      []string  `json:"read"`
+	Write     []string  `json:"write"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type GrantListResponse struct {
+	Ok     bool        `json:"ok"`
+	Grants []GrantInfo `json:"grants"`
+}
+
+// GrantRequest lists the prefixes of the namespace to give access to,
+// write access implies read access
+type GrantRequest struct {
+	Read  []string `json:"read"`
+	Write []string `json:"write"`
+}
+
+type GrantResponse struct {
+	Ok    bool      `json:"ok"`
+	Grant GrantInfo `json:"grant"`
+}
+
+type RegisterRequest struct {
+	Code    string `json:"code"`
+	User    string `json:"user"`
+	AuthKey string `json:"key"`
+}
+
+type RegisterResponse struct {
 	Ok    bool   `json:"ok"`
-	User  string `json:"username"`
+	User  string `json:"user"`
 	Level string `json:"level"`
-	Token string `json:"token"`
+}
+
+type AuditEntry struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	User      string    `json:"user"`
+	Action    string    `json:"action"`
+	Success   bool      `json:"success"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Details   string    `json:"details,omitempty"`
+}
+
+type AuditLogResponse struct {
+	Ok      bool         `json:"ok"`
+	Entries []AuditEntry `json:"entries"`
+}
+
+type TOTPEnrollResponse struct {
+	Ok     bool   `json:"ok"`
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type TOTPCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type TOTPConfirmResponse struct {
+	Ok            bool     `json:"ok"`
+	RecoveryCodes []string `json:"recovery_codes"`
 }
 
 const KVKeyPrefix = "stulbe/"
@@ -0,0 +1,264 @@
+package archive
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+
+	"github.com/strimertul/stulbe/database"
+)
+
+var json = jsoniter.ConfigFastest
+
+// Version of the archive format, archives with a newer version are rejected
+const Version = 1
+
+type Format string
+
+const (
+	// FormatJSON is a single JSON object with every entry in "entries"
+	FormatJSON Format = "json"
+	// FormatNDJSON has the header on the first line followed by one entry per line
+	FormatNDJSON Format = "ndjson"
+)
+
+// Mode controls what happens to keys that exist but aren't in the archive
+type Mode string
+
+const (
+	// ModeMerge writes the archived keys and leaves every other key alone
+	ModeMerge Mode = "merge"
+	// ModeReplace also removes the keys that aren't in the archive
+	ModeReplace Mode = "replace"
+)
+
+var (
+	ErrUnknownFormat      = errors.New("unknown archive format")
+	ErrUnknownMode        = errors.New("unknown import mode")
+	ErrInvalidArchive     = errors.New("invalid archive")
+	ErrUnsupportedVersion = errors.New("archive was made by a newer version")
+	ErrForbiddenKey       = errors.New("archive contains keys that can't be written")
+)
+
+// Header describes where an archive comes from
+type Header struct {
+	Version   int       `json:"version"`
+	Namespace string    `json:"namespace"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Entry is a single key, relative to the exported prefix
+type Entry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type Archive struct {
+	Header
+	Entries []Entry `json:"entries"`
+}
+
+// Result counts the changes an import made (or would make, for dry runs)
+type Result struct {
+	Added     int
+	Updated   int
+	Unchanged int
+	Removed   int
+}
+
+type ImportOptions struct {
+	Mode   Mode
+	DryRun bool
+	// If set, only keys it returns true for can be written or removed
+	Filter func(key string) bool
+}
+
+// ValidFormat returns true if the format is a known archive format
+func ValidFormat(format Format) bool {
+	return format == FormatJSON || format == FormatNDJSON
+}
+
+// Export writes every key starting with prefix to w, keys are stored without
+// the prefix so that archives can be imported under a different one. If filter
+// is set, only keys it returns true for are exported.
+func Export(ctx context.Context, db *database.DBModule, w io.Writer, format Format, namespace string, prefix string, filter func(key string) bool) (int, error) {
+	if !ValidFormat(format) {
+		return 0, ErrUnknownFormat
+	}
+
+	// Read everything before writing anything, so errors can still be reported
+	data, err := db.GetAll(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		relative := strings.TrimPrefix(key, prefix)
+		if filter != nil && !filter(relative) {
+			continue
+		}
+		keys = append(keys, relative)
+	}
+	sort.Strings(keys)
+
+	out := bufio.NewWriter(w)
+	header, err := json.Marshal(Header{
+		Version:   Version,
+		Namespace: namespace,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		return 0, err
+	}
+	if format == FormatJSON {
+		// Entries are appended to the header object one by one
+		_, _ = out.Write(header[:len(header)-1])
+		_, _ = out.WriteString(`,"entries":[`)
+	} else {
+		_, _ = out.Write(header)
+		_ = out.WriteByte('\n')
+	}
+
+	for i, key := range keys {
+		entry, err := json.Marshal(Entry{Key: key, Value: data[prefix+key]})
+		if err != nil {
+			return i, err
+		}
+		if format == FormatJSON && i > 0 {
+			_ = out.WriteByte(',')
+		}
+		_, _ = out.Write(entry)
+		if format == FormatNDJSON {
+			_ = out.WriteByte('\n')
+		}
+	}
+
+	if format == FormatJSON {
+		_, _ = out.WriteString("]}\n")
+	}
+	return len(keys), out.Flush()
+}
+
+// Read parses an archive in either format
+func Read(r io.Reader) (*Archive, error) {
+	decoder := json.NewDecoder(r)
+
+	var archive Archive
+	if err := decoder.Decode(&archive); err != nil {
+		return nil, ErrInvalidArchive
+	}
+	if archive.Version < 1 {
+		return nil, ErrInvalidArchive
+	}
+	if archive.Version > Version {
+		return nil, ErrUnsupportedVersion
+	}
+
+	// NDJSON archives only have the header in the first line
+	if archive.Entries == nil {
+		for decoder.More() {
+			var entry Entry
+			if err := decoder.Decode(&entry); err != nil {
+				return nil, ErrInvalidArchive
+			}
+			archive.Entries = append(archive.Entries, entry)
+		}
+	}
+
+	for _, entry := range archive.Entries {
+		if entry.Key == "" {
+			return nil, ErrInvalidArchive
+		}
+	}
+	return &archive, nil
+}
+
+// Import writes the keys of an archive under prefix. All changes are applied
+// in a single transaction, unless it's a dry run in which case nothing is written.
+func Import(ctx context.Context, db *database.DBModule, prefix string, archive *Archive, options ImportOptions) (Result, error) {
+	if options.Mode != ModeMerge && options.Mode != ModeReplace {
+		return Result{}, ErrUnknownMode
+	}
+	if options.Filter != nil {
+		for _, entry := range archive.Entries {
+			if !options.Filter(entry.Key) {
+				return Result{}, ErrForbiddenKey
+			}
+		}
+	}
+
+	existing, err := db.ListKeys(ctx, prefix)
+	if err != nil {
+		return Result{}, err
+	}
+	keys := existing
+	for _, entry := range archive.Entries {
+		keys = append(keys, prefix+entry.Key)
+	}
+
+	if options.DryRun {
+		values := make(map[string]string)
+		for _, key := range keys {
+			value, _, err := db.GetKeyVersioned(ctx, key)
+			if err != nil {
+				return Result{}, err
+			}
+			values[key] = value
+		}
+		_, result := diff(values, prefix, archive, options)
+		return result, nil
+	}
+
+	var result Result
+	err = db.Transaction(ctx, keys, func(values map[string]string) (map[string]string, error) {
+		var changes map[string]string
+		changes, result = diff(values, prefix, archive, options)
+		return changes, nil
+	})
+	return result, err
+}
+
+// diff returns the changes needed to apply an archive to the current values
+func diff(values map[string]string, prefix string, archive *Archive, options ImportOptions) (map[string]string, Result) {
+	var result Result
+	changes := make(map[string]string)
+	archived := make(map[string]bool)
+	for _, entry := range archive.Entries {
+		// Empty values can't be stored, they are the same as a missing key
+		if entry.Value == "" {
+			continue
+		}
+		key := prefix + entry.Key
+		archived[key] = true
+		switch values[key] {
+		case "":
+			result.Added++
+		case entry.Value:
+			result.Unchanged++
+			continue
+		default:
+			result.Updated++
+		}
+		changes[key] = entry.Value
+	}
+
+	if options.Mode == ModeReplace {
+		for key, value := range values {
+			if value == "" || archived[key] {
+				continue
+			}
+			if options.Filter != nil && !options.Filter(strings.TrimPrefix(key, prefix)) {
+				continue
+			}
+			changes[key] = ""
+			result.Removed++
+		}
+	}
+	return changes, result
+}
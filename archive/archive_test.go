@@ -0,0 +1,184 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/strimertul/stulbe/database"
+	"github.com/strimertul/stulbe/internal/dbtest"
+)
+
+func putKeys(t *testing.T, db *database.DBModule, keys map[string]string) {
+	t.Helper()
+	for key, value := range keys {
+		if err := db.PutKey(context.Background(), key, value); err != nil {
+			t.Fatalf("writing key: %s", err)
+		}
+	}
+}
+
+func checkKeys(t *testing.T, db *database.DBModule, prefix string, expected map[string]string) {
+	t.Helper()
+	data, err := db.GetAll(context.Background(), prefix)
+	if err != nil {
+		t.Fatalf("reading keys: %s", err)
+	}
+	for key, value := range data {
+		if value == "" {
+			delete(data, key)
+		}
+	}
+	if len(data) != len(expected) {
+		t.Errorf("expected %d keys under %s, got %v", len(expected), prefix, data)
+	}
+	for key, value := range expected {
+		if data[key] != value {
+			t.Errorf("expected %s to be %q, got %q", key, value, data[key])
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, format := range []Format{FormatJSON, FormatNDJSON} {
+		t.Run(string(format), func(t *testing.T) {
+			ctx := context.Background()
+			db := dbtest.New(t)
+			putKeys(t, db, map[string]string{
+				"alice/config":      `{"theme":"dark"}`,
+				"alice/loyalty/one": "1",
+				"alice/loyalty/two": "line\nbreak \"quoted\"",
+				"bob/config":        "not exported",
+			})
+
+			var buf bytes.Buffer
+			count, err := Export(ctx, db, &buf, format, "alice", "alice/", nil)
+			if err != nil {
+				t.Fatalf("exporting: %s", err)
+			}
+			if count != 3 {
+				t.Errorf("expected 3 keys to be exported, got %d", count)
+			}
+			if format == FormatNDJSON && strings.Count(buf.String(), "\n") != 4 {
+				t.Errorf("expected a header and 3 entries on separate lines, got %q", buf.String())
+			}
+
+			archive, err := Read(&buf)
+			if err != nil {
+				t.Fatalf("reading archive: %s", err)
+			}
+			if archive.Namespace != "alice" || len(archive.Entries) != 3 {
+				t.Fatalf("unexpected archive contents: %+v", archive)
+			}
+
+			// Import into a namespace with a key that isn't in the archive
+			putKeys(t, db, map[string]string{
+				"carol/config": "old",
+				"carol/extra":  "kept on merge",
+			})
+			result, err := Import(ctx, db, "carol/", archive, ImportOptions{Mode: ModeMerge})
+			if err != nil {
+				t.Fatalf("importing: %s", err)
+			}
+			if result != (Result{Added: 2, Updated: 1}) {
+				t.Errorf("unexpected merge result: %+v", result)
+			}
+			checkKeys(t, db, "carol/", map[string]string{
+				"carol/config":      `{"theme":"dark"}`,
+				"carol/loyalty/one": "1",
+				"carol/loyalty/two": "line\nbreak \"quoted\"",
+				"carol/extra":       "kept on merge",
+			})
+
+			// Importing again changes nothing, replacing removes the extra key
+			result, err = Import(ctx, db, "carol/", archive, ImportOptions{Mode: ModeReplace})
+			if err != nil {
+				t.Fatalf("importing: %s", err)
+			}
+			if result != (Result{Unchanged: 3, Removed: 1}) {
+				t.Errorf("unexpected replace result: %+v", result)
+			}
+			checkKeys(t, db, "carol/", map[string]string{
+				"carol/config":      `{"theme":"dark"}`,
+				"carol/loyalty/one": "1",
+				"carol/loyalty/two": "line\nbreak \"quoted\"",
+			})
+
+			// The source namespace is untouched
+			checkKeys(t, db, "alice/", map[string]string{
+				"alice/config":      `{"theme":"dark"}`,
+				"alice/loyalty/one": "1",
+				"alice/loyalty/two": "line\nbreak \"quoted\"",
+			})
+		})
+	}
+}
+
+func TestImportDryRun(t *testing.T) {
+	ctx := context.Background()
+	db := dbtest.New(t)
+	putKeys(t, db, map[string]string{
+		"alice/config": "old",
+		"alice/extra":  "extra",
+	})
+
+	archive := &Archive{
+		Header: Header{Version: Version, Namespace: "alice"},
+		Entries: []Entry{
+			{Key: "config", Value: "new"},
+			{Key: "added", Value: "added"},
+		},
+	}
+	result, err := Import(ctx, db, "alice/", archive, ImportOptions{Mode: ModeReplace, DryRun: true})
+	if err != nil {
+		t.Fatalf("importing: %s", err)
+	}
+	if result != (Result{Added: 1, Updated: 1, Removed: 1}) {
+		t.Errorf("unexpected dry run result: %+v", result)
+	}
+	checkKeys(t, db, "alice/", map[string]string{
+		"alice/config": "old",
+		"alice/extra":  "extra",
+	})
+}
+
+func TestImportFilter(t *testing.T) {
+	ctx := context.Background()
+	db := dbtest.New(t)
+
+	archive := &Archive{
+		Header: Header{Version: Version, Namespace: "alice"},
+		Entries: []Entry{
+			{Key: "config", Value: "value"},
+			{Key: "private/secret", Value: "value"},
+		},
+	}
+	_, err := Import(ctx, db, "alice/", archive, ImportOptions{
+		Mode: ModeMerge,
+		Filter: func(key string) bool {
+			return !strings.HasPrefix(key, "private/")
+		},
+	})
+	if err != ErrForbiddenKey {
+		t.Fatalf("expected forbidden key error, got %v", err)
+	}
+	checkKeys(t, db, "alice/", map[string]string{})
+}
+
+func TestReadInvalid(t *testing.T) {
+	tests := map[string]error{
+		"":                             ErrInvalidArchive,
+		"not json":                     ErrInvalidArchive,
+		`{"version":0}`:                ErrInvalidArchive,
+		`{"version":99}`:               ErrUnsupportedVersion,
+		`{"version":1,"entries":[{}]}`: ErrInvalidArchive,
+		`{"version":1}` + "\n" + `{"k`: ErrInvalidArchive,
+		`{"version":1,"entries":[]}`:   nil,
+	}
+	for input, expected := range tests {
+		if _, err := Read(strings.NewReader(input)); err != expected {
+			t.Errorf("reading %q: expected %v, got %v", input, expected, err)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package audit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"go.uber.org/zap"
+
+	"github.com/strimertul/stulbe/database"
+)
+
+var json = jsoniter.ConfigFastest
+
+// Entries are grouped by day so that queries only read the days they need
+const (
+	auditPrefix = "stulbe-audit/"
+	dayFormat   = "2006-01-02"
+)
+
+const (
+	// Range used for queries without a start time
+	defaultQueryRange = 7 * 24 * time.Hour
+	// Maximum number of entries returned by a query
+	maxQueryLimit = 1000
+)
+
+type Action string
+
+const (
+	ActionLogin                    Action = "login"
+	ActionTokenRejected            Action = "token_rejected"
+	ActionTokenRefresh             Action = "token_refresh"
+	ActionWebsocketConnect         Action = "ws_connect"
+	ActionTwitchAuthorize          Action = "twitch_authorize"
+	ActionTwitchLogin              Action = "twitch_login"
+	ActionTwitchClearSubscriptions Action = "twitch_clear_subscriptions"
+	ActionNamespaceExport          Action = "kv_export"
+	ActionNamespaceImport          Action = "kv_import"
+)
+
+// Entry is a single audit log record
+type Entry struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	User      string    `json:"user"`
+	Action    Action    `json:"action"`
+	Success   bool      `json:"success"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Details   string    `json:"details,omitempty"`
+}
+
+// Filter restricts which entries are returned by Query, zero values match everything
+type Filter struct {
+	User   string
+	Action Action
+	From   time.Time
+	To     time.Time
+	Limit  int
+}
+
+// Log is an append-only log of authentication related events stored in KV
+type Log struct {
+	db     *database.DBModule
+	logger *zap.Logger
+}
+
+func New(db *database.DBModule, logger *zap.Logger) *Log {
+	if logger == nil {
+		logger, _ = zap.NewProduction()
+	}
+	return &Log{
+		db:     db,
+		logger: logger,
+	}
+}
+
+// Record appends an entry to the log, failures are logged but not returned
+// since they shouldn't stop whatever is being audited
+func (l *Log) Record(ctx context.Context, entry Entry) {
+	entry.Time = time.Now()
+
+	suffix := make([]byte, 4)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		l.logger.Error("could not generate audit entry ID", zap.Error(err))
+		return
+	}
+	// Zero-padded timestamp first so that keys sort chronologically
+	entry.ID = fmt.Sprintf("%019d-%s", entry.Time.UnixNano(), hex.EncodeToString(suffix))
+
+	key := auditPrefix + entry.Time.UTC().Format(dayFormat) + "/" + entry.ID
+	err = l.db.PutJSON(ctx, key, entry)
+	if err != nil {
+		l.logger.Error("could not write audit entry", zap.String("action", string(entry.Action)), zap.String("user", entry.User), zap.Error(err))
+	}
+}
+
+// Query returns entries matching the filter, newest first
+func (l *Log) Query(ctx context.Context, filter Filter) ([]Entry, error) {
+	if filter.To.IsZero() {
+		filter.To = time.Now()
+	}
+	if filter.From.IsZero() {
+		filter.From = filter.To.Add(-defaultQueryRange)
+	}
+	if filter.Limit <= 0 || filter.Limit > maxQueryLimit {
+		filter.Limit = maxQueryLimit
+	}
+
+	entries := []Entry{}
+	lastDay := filter.To.UTC().Format(dayFormat)
+	for day := filter.From.UTC(); ; day = day.AddDate(0, 0, 1) {
+		dayStr := day.Format(dayFormat)
+		if dayStr > lastDay {
+			break
+		}
+
+		data, err := l.db.GetAll(ctx, auditPrefix+dayStr+"/")
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range data {
+			if value == "" {
+				continue
+			}
+			var entry Entry
+			err := json.Unmarshal([]byte(value), &entry)
+			if err != nil {
+				l.logger.Warn("skipping invalid audit entry", zap.String("key", key), zap.Error(err))
+				continue
+			}
+			if entry.Time.Before(filter.From) || entry.Time.After(filter.To) {
+				continue
+			}
+			if filter.User != "" && entry.User != filter.User {
+				continue
+			}
+			if filter.Action != "" && entry.Action != filter.Action {
+				continue
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ID > entries[j].ID
+	})
+	if len(entries) > filter.Limit {
+		entries = entries[:filter.Limit]
+	}
+	return entries, nil
+}
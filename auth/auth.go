@@ -1,9 +1,11 @@
 package auth
 
 import (
-	"crypto/rand"
-	"encoding/hex"
+	"context"
+	"sync"
+	"time"
 
+	jsoniter "github.com/json-iterator/go"
 	kv "github.com/strimertul/kilovolt/v8"
 
 	"go.uber.org/zap"
@@ -11,30 +13,71 @@ import (
 	"github.com/strimertul/stulbe/database"
 )
 
+var json = jsoniter.ConfigFastest
+
 type Storage struct {
-	db        *database.DBModule
-	users     UserList
-	secretKey []byte
-	logger    *zap.Logger
+	db      *database.DBModule
+	users   UserList
+	usersMu sync.RWMutex
+	keys    KeyRing
+	keyMu   sync.RWMutex
+	logger  *zap.Logger
+
+	// Hashes of the user lists we wrote and haven't been notified about yet,
+	// with how many times each was written
+	pendingWrites map[string]int
+	// User list changes waiting to be applied
+	updates      []string
+	updatesMu    sync.Mutex
+	updateSignal chan struct{}
+
+	algorithm string
+
+	tokenLifetimes  map[UserLevel]time.Duration
+	refreshLifetime time.Duration
 }
 
 type Options struct {
 	Logger              *zap.Logger
 	ForgeGenerateSecret bool
-}
 
-const secretKey = "stulbe-auth/secret"
+	// Algorithm used for new signing keys (HS256 if empty), changing it
+	// rotates the active key on startup
+	SigningAlgorithm string
+
+	// How long access tokens are valid for each level, levels that aren't
+	// listed use DefaultTokenLifetime
+	TokenLifetimes map[UserLevel]time.Duration
+	// How long refresh tokens are valid for (DefaultRefreshLifetime if zero)
+	RefreshLifetime time.Duration
+}
 
-func Init(db *database.DBModule, options Options) (*Storage, error) {
+func Init(ctx context.Context, db *database.DBModule, options Options) (*Storage, error) {
 	store := &Storage{
-		db:        db,
-		users:     nil,
-		logger:    options.Logger,
-		secretKey: nil,
+		db:     db,
+		users:  nil,
+		keys:   nil,
+		logger: options.Logger,
+
+		pendingWrites: make(map[string]int),
+		updateSignal:  make(chan struct{}, 1),
+		algorithm:     options.SigningAlgorithm,
+
+		tokenLifetimes:  options.TokenLifetimes,
+		refreshLifetime: options.RefreshLifetime,
+	}
+	if store.algorithm == "" {
+		store.algorithm = AlgHS256
+	}
+	if store.refreshLifetime <= 0 {
+		store.refreshLifetime = DefaultRefreshLifetime
+	}
+	if !ValidAlgorithm(store.algorithm) {
+		return nil, ErrUnknownAlgorithm
 	}
 
 	// Get user/session lists from DB, if we can
-	err := db.GetJSON(usersKey, &store.users)
+	err := db.GetJSON(ctx, usersKey, &store.users)
 	if err != nil {
 		if err == kv.ErrorKeyNotFound {
 			store.users = make(UserList)
@@ -44,25 +87,44 @@ func Init(db *database.DBModule, options Options) (*Storage, error) {
 		}
 	}
 
+	// Reload users when they are changed by someone else
+	go store.watchUsers()
+	err = db.Subscribe(ctx, store.onUsersChanged, usersKey)
+	if err != nil {
+		return nil, err
+	}
+
 	if options.ForgeGenerateSecret {
-		err = store.generateSecret()
+		err = store.resetKeyRing(ctx)
 		if err != nil {
 			return nil, err
 		}
 	} else {
-		hexkey, err := db.GetKey(secretKey)
+		err = store.loadKeyRing(ctx)
 		if err != nil {
+			if err != kv.ErrorKeyNotFound {
+				return nil, err
+			}
+			// Start from the legacy secret if there is one, or generate a new key ring
+			err = store.importLegacySecret(ctx)
 			if err == kv.ErrorKeyNotFound {
-				// Generate random key
-				err = store.generateSecret()
-				if err != nil {
-					return nil, err
-				}
-			} else {
+				store.logger.Warn("no signing keys found, generating new key ring")
+				err = store.resetKeyRing(ctx)
+			}
+			if err != nil {
 				return nil, err
 			}
 		}
-		store.secretKey, err = hex.DecodeString(hexkey)
+	}
+
+	// Switch to the configured algorithm if the active key uses another one
+	active, err := store.activeKey()
+	if err != nil {
+		return nil, err
+	}
+	if active.Alg() != store.algorithm {
+		store.logger.Info("signing algorithm changed, rotating key", zap.String("from", active.Alg()), zap.String("to", store.algorithm))
+		_, err = store.RotateKey(ctx, defaultRotationGrace)
 		if err != nil {
 			return nil, err
 		}
@@ -71,18 +133,35 @@ func Init(db *database.DBModule, options Options) (*Storage, error) {
 	return store, nil
 }
 
-func (db *Storage) generateSecret() error {
-	db.logger.Warn("no secret key found, generating one")
-	db.secretKey = make([]byte, 32)
-	_, err := rand.Read(db.secretKey)
+// getVersionedJSON reads a JSON record along with its version, returning
+// kv.ErrorKeyNotFound if it doesn't exist
+func (db *Storage) getVersionedJSON(ctx context.Context, key string, dst interface{}) (database.Version, error) {
+	value, version, err := db.db.GetKeyVersioned(ctx, key)
 	if err != nil {
-		return err
+		return "", err
+	}
+	if version == "" {
+		return "", kv.ErrorKeyNotFound
 	}
-	hexkey := hex.EncodeToString(db.secretKey)
-	err = db.db.PutKey(secretKey, hexkey)
+	return version, json.Unmarshal([]byte(value), dst)
+}
+
+// removeIfUnchanged removes a record only if it still has the given version,
+// concurrent callers trying to consume the same record get kv.ErrorKeyNotFound
+func (db *Storage) removeIfUnchanged(ctx context.Context, key string, version database.Version) error {
+	err := db.db.CompareAndSwap(ctx, key, version, "")
+	if err == database.ErrVersionMismatch {
+		return kv.ErrorKeyNotFound
+	}
+	return err
+}
+
+// consumeJSON reads a single-use record and removes it, only one caller can
+// consume a record, everyone else gets kv.ErrorKeyNotFound
+func (db *Storage) consumeJSON(ctx context.Context, key string, dst interface{}) error {
+	version, err := db.getVersionedJSON(ctx, key, dst)
 	if err != nil {
 		return err
 	}
-	db.logger.Info("generated secret key", zap.String("key", hexkey))
-	return nil
+	return db.removeIfUnchanged(ctx, key, version)
 }
@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	kv "github.com/strimertul/kilovolt/v8"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrGrantNotFound = errors.New("grant not found")
+	ErrInvalidGrant  = errors.New("invalid grant")
+)
+
+const grantsPrefix = "stulbe-auth/grants/"
+
+// Grant gives another user access to some prefixes of the owner's namespace
+type Grant struct {
+	Owner     string    `json:"owner"`
+	Grantee   string    `json:"grantee"`
+	Read      []string  `json:"read,omitempty"`
+	Write     []string  `json:"write,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Scopes returns the KV scopes equivalent to the grant
+func (g Grant) Scopes() []string {
+	scopes := make([]string, 0, len(g.Read)+len(g.Write))
+	for _, prefix := range g.Read {
+		scopes = append(scopes, ScopeKVReadPrefix+prefix)
+	}
+	for _, prefix := range g.Write {
+		scopes = append(scopes, ScopeKVWritePrefix+prefix)
+	}
+	return scopes
+}
+
+// Claims returns claims for the grantee restricted to the grant, to be used
+// when accessing the owner's namespace
+func (g Grant) Claims(claims *UserClaims) *UserClaims {
+	delegated := *claims
+	delegated.Scopes = g.Scopes()
+	return &delegated
+}
+
+func grantKey(owner string, grantee string) string {
+	return grantsPrefix + owner + "/" + grantee
+}
+
+// SetGrant gives (or replaces) access to prefixes of the owner's namespace
+func (db *Storage) SetGrant(ctx context.Context, owner string, grantee string, read []string, write []string) (Grant, error) {
+	if owner == grantee || len(read)+len(write) < 1 {
+		return Grant{}, ErrInvalidGrant
+	}
+	if _, ok := db.GetUser(grantee); !ok {
+		return Grant{}, ErrUserNotFound
+	}
+
+	grant := Grant{
+		Owner:     owner,
+		Grantee:   grantee,
+		Read:      read,
+		Write:     write,
+		CreatedAt: time.Now(),
+	}
+	return grant, db.db.PutJSON(ctx, grantKey(owner, grantee), grant)
+}
+
+// GetGrant retrieves the grant the owner gave to the grantee
+func (db *Storage) GetGrant(ctx context.Context, owner string, grantee string) (Grant, error) {
+	var grant Grant
+	err := db.db.GetJSON(ctx, grantKey(owner, grantee), &grant)
+	if err != nil {
+		if err == kv.ErrorKeyNotFound {
+			return Grant{}, ErrGrantNotFound
+		}
+		return Grant{}, err
+	}
+	return grant, nil
+}
+
+// listGrants returns all grants matching a filter
+func (db *Storage) listGrants(ctx context.Context, prefix string, filter func(Grant) bool) ([]Grant, error) {
+	data, err := db.db.GetAll(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	grants := []Grant{}
+	for key, value := range data {
+		if value == "" {
+			continue
+		}
+		var grant Grant
+		err := json.Unmarshal([]byte(value), &grant)
+		if err != nil {
+			db.logger.Warn("skipping invalid grant record", zap.String("key", key), zap.Error(err))
+			continue
+		}
+		if filter(grant) {
+			grants = append(grants, grant)
+		}
+	}
+
+	sort.Slice(grants, func(i, j int) bool {
+		return grants[i].CreatedAt.Before(grants[j].CreatedAt)
+	})
+	return grants, nil
+}
+
+// ListGrants returns all grants given by a user
+func (db *Storage) ListGrants(ctx context.Context, owner string) ([]Grant, error) {
+	prefix := grantKey(owner, "")
+	return db.listGrants(ctx, prefix, func(grant Grant) bool {
+		// Other users sharing the same prefix
+		return grant.Owner == owner
+	})
+}
+
+// ListReceivedGrants returns all grants given to a user
+func (db *Storage) ListReceivedGrants(ctx context.Context, grantee string) ([]Grant, error) {
+	return db.listGrants(ctx, grantsPrefix, func(grant Grant) bool {
+		return grant.Grantee == grantee
+	})
+}
+
+// RevokeGrant removes the grant the owner gave to the grantee
+func (db *Storage) RevokeGrant(ctx context.Context, owner string, grantee string) error {
+	_, err := db.GetGrant(ctx, owner, grantee)
+	if err != nil {
+		return err
+	}
+	return db.db.RemoveKey(ctx, grantKey(owner, grantee))
+}
+
+// removeUserGrants removes all grants given by or to a user
+func (db *Storage) removeUserGrants(ctx context.Context, user string) error {
+	grants, err := db.listGrants(ctx, grantsPrefix, func(grant Grant) bool {
+		return grant.Owner == user || grant.Grantee == user
+	})
+	if err != nil {
+		return err
+	}
+	for _, grant := range grants {
+		err = db.db.RemoveKey(ctx, grantKey(grant.Owner, grant.Grantee))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
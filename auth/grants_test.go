@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestGrantClaims(t *testing.T) {
+	grant := Grant{
+		Owner:   "streamer",
+		Grantee: "mod",
+		Read:    []string{"overlay/"},
+		Write:   []string{"chat/"},
+	}
+
+	expected := []string{ScopeKVReadPrefix + "overlay/", ScopeKVWritePrefix + "chat/"}
+	if scopes := grant.Scopes(); !reflect.DeepEqual(scopes, expected) {
+		t.Fatalf("expected %v, got %v", expected, scopes)
+	}
+
+	claims := &UserClaims{User: "mod", Level: ULModerator}
+	delegated := grant.Claims(claims)
+	if delegated.User != "mod" || delegated.Level != ULModerator {
+		t.Errorf("expected the grantee's identity to be kept, got %+v", delegated)
+	}
+	if claims.Scoped() {
+		t.Errorf("expected the original claims to be left unscoped, got %v", claims.Scopes)
+	}
+
+	tests := []struct {
+		key   string
+		read  bool
+		write bool
+	}{
+		{"overlay/title", true, false},
+		{"chat/last", true, true},
+		{"secret", false, false},
+		// Scopes are plain prefixes
+		{"overlay", false, false},
+		{"chat/", true, true},
+	}
+	for _, test := range tests {
+		if read := delegated.CanRead(test.key); read != test.read {
+			t.Errorf("%s: expected read=%v, got %v", test.key, test.read, read)
+		}
+		if write := delegated.CanWrite(test.key); write != test.write {
+			t.Errorf("%s: expected write=%v, got %v", test.key, test.write, write)
+		}
+	}
+}
+
+func TestSetGrant(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStorage(t)
+
+	for _, user := range []string{"streamer", "mod"} {
+		if err := store.CreateUser(ctx, user, "password", ULStreamer); err != nil {
+			t.Fatalf("creating user: %s", err)
+		}
+	}
+
+	if _, err := store.SetGrant(ctx, "streamer", "streamer", []string{"a/"}, nil); err != ErrInvalidGrant {
+		t.Errorf("expected self grants to be invalid, got %v", err)
+	}
+	if _, err := store.SetGrant(ctx, "streamer", "mod", nil, nil); err != ErrInvalidGrant {
+		t.Errorf("expected empty grants to be invalid, got %v", err)
+	}
+	if _, err := store.SetGrant(ctx, "streamer", "nobody", []string{"a/"}, nil); err != ErrUserNotFound {
+		t.Errorf("expected unknown grantee to be refused, got %v", err)
+	}
+
+	if _, err := store.SetGrant(ctx, "streamer", "mod", []string{"overlay/"}, nil); err != nil {
+		t.Fatalf("setting grant: %s", err)
+	}
+	// Setting it again replaces the prefixes
+	if _, err := store.SetGrant(ctx, "streamer", "mod", nil, []string{"chat/"}); err != nil {
+		t.Fatalf("replacing grant: %s", err)
+	}
+	grant, err := store.GetGrant(ctx, "streamer", "mod")
+	if err != nil {
+		t.Fatalf("getting grant: %s", err)
+	}
+	if expected := []string{ScopeKVWritePrefix + "chat/"}; !reflect.DeepEqual(grant.Scopes(), expected) {
+		t.Errorf("expected %v, got %v", expected, grant.Scopes())
+	}
+
+	// Grants only go one way
+	if _, err := store.GetGrant(ctx, "mod", "streamer"); err != ErrGrantNotFound {
+		t.Errorf("expected no grant from mod, got %v", err)
+	}
+
+	if err := store.RevokeGrant(ctx, "streamer", "mod"); err != nil {
+		t.Fatalf("revoking grant: %s", err)
+	}
+	if _, err := store.GetGrant(ctx, "streamer", "mod"); err != ErrGrantNotFound {
+		t.Errorf("expected revoked grant to be gone, got %v", err)
+	}
+}
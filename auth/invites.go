@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	kv "github.com/strimertul/kilovolt/v8"
+	"go.uber.org/zap"
+
+	"github.com/strimertul/stulbe/database"
+)
+
+var (
+	ErrInvalidInvite  = errors.New("invalid or expired invite code")
+	ErrInviteNotFound = errors.New("invite not found")
+)
+
+const invitesPrefix = "stulbe-auth/invites/"
+
+// Invite allows creating a streamer account without an admin picking its key,
+// only the hash of the code is stored and used as the invite ID
+type Invite struct {
+	ID        string    `json:"id"`
+	CreatedBy string    `json:"created_by"`
+	Note      string    `json:"note,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// CreateInvite issues a single-use invite code
+func (db *Storage) CreateInvite(ctx context.Context, createdBy string, note string, lifetime time.Duration) (string, Invite, error) {
+	code, err := randomHex(24)
+	if err != nil {
+		return "", Invite{}, err
+	}
+
+	now := time.Now()
+	invite := Invite{
+		ID:        hashToken(code),
+		CreatedBy: createdBy,
+		Note:      note,
+		CreatedAt: now,
+		ExpiresAt: now.Add(lifetime),
+	}
+	return code, invite, db.db.PutJSONTTL(ctx, invitesPrefix+invite.ID, invite, lifetime)
+}
+
+// ListInvites returns all pending invites, removing expired ones
+func (db *Storage) ListInvites(ctx context.Context) ([]Invite, error) {
+	data, err := db.db.GetAll(ctx, invitesPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	invites := []Invite{}
+	for key, value := range data {
+		if value == "" {
+			continue
+		}
+		var invite Invite
+		err := json.Unmarshal([]byte(value), &invite)
+		if err != nil {
+			db.logger.Warn("skipping invalid invite record", zap.String("key", key), zap.Error(err))
+			continue
+		}
+		if invite.ExpiresAt.Before(now) {
+			err = db.db.RemoveKey(ctx, key)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		invites = append(invites, invite)
+	}
+
+	sort.Slice(invites, func(i, j int) bool {
+		return invites[i].CreatedAt.Before(invites[j].CreatedAt)
+	})
+	return invites, nil
+}
+
+// DeleteInvite revokes a pending invite by its ID
+func (db *Storage) DeleteInvite(ctx context.Context, id string) error {
+	_, err := db.db.GetKey(ctx, invitesPrefix+id)
+	if err != nil {
+		if err == kv.ErrorKeyNotFound {
+			return ErrInviteNotFound
+		}
+		return err
+	}
+	return db.db.RemoveKey(ctx, invitesPrefix+id)
+}
+
+// RedeemInvite consumes an invite code and creates a streamer account with it
+func (db *Storage) RedeemInvite(ctx context.Context, code string, username string, key string) (Invite, error) {
+	if !ValidUsername(username) {
+		return Invite{}, ErrInvalidUsername
+	}
+	if key == "" {
+		return Invite{}, ErrInvalidKey
+	}
+	inviteKey := invitesPrefix + hashToken(code)
+
+	var invite Invite
+	version, err := db.getVersionedJSON(ctx, inviteKey, &invite)
+	if err != nil {
+		if err == kv.ErrorKeyNotFound {
+			return Invite{}, ErrInvalidInvite
+		}
+		return Invite{}, err
+	}
+	if invite.ExpiresAt.Before(time.Now()) {
+		return Invite{}, ErrInvalidInvite
+	}
+
+	// Check the name before consuming the invite so it can be retried with another one
+	if _, ok := db.GetUser(username); ok {
+		return Invite{}, ErrUserExists
+	}
+
+	// Only one request can consume the invite
+	err = db.removeIfUnchanged(ctx, inviteKey, version)
+	if err != nil {
+		if err == kv.ErrorKeyNotFound {
+			return Invite{}, ErrInvalidInvite
+		}
+		return Invite{}, err
+	}
+
+	err = db.CreateUser(ctx, username, key, ULStreamer)
+	if err != nil {
+		// Give the invite back, unless it expired in the meantime
+		if lifetime := time.Until(invite.ExpiresAt); lifetime > 0 {
+			if restoreErr := db.restoreInvite(ctx, inviteKey, invite, lifetime); restoreErr != nil {
+				db.logger.Error("could not restore invite", zap.String("invite", invite.ID), zap.Error(restoreErr))
+			}
+		}
+		return Invite{}, err
+	}
+	return invite, nil
+}
+
+func (db *Storage) restoreInvite(ctx context.Context, inviteKey string, invite Invite, lifetime time.Duration) error {
+	byt, err := json.Marshal(invite)
+	if err != nil {
+		return err
+	}
+	// Only if it's still missing, so that nothing else is overwritten
+	err = db.db.CompareAndSwapTTL(ctx, inviteKey, "", string(byt), lifetime)
+	if err == database.ErrVersionMismatch {
+		return nil
+	}
+	return err
+}
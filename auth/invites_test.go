@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRedeemInvite(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStorage(t)
+
+	if err := store.CreateUser(ctx, "taken", "password", ULStreamer); err != nil {
+		t.Fatalf("creating user: %s", err)
+	}
+	code, invite, err := store.CreateInvite(ctx, "admin", "for newbie", time.Hour)
+	if err != nil {
+		t.Fatalf("creating invite: %s", err)
+	}
+
+	if _, err := store.RedeemInvite(ctx, "not a code", "newbie", "password"); err != ErrInvalidInvite {
+		t.Errorf("expected unknown code to be invalid, got %v", err)
+	}
+	// Taken names don't use up the invite
+	if _, err := store.RedeemInvite(ctx, code, "taken", "password"); err != ErrUserExists {
+		t.Errorf("expected taken name to be refused, got %v", err)
+	}
+	invites, err := store.ListInvites(ctx)
+	if err != nil {
+		t.Fatalf("listing invites: %s", err)
+	}
+	if len(invites) != 1 || invites[0].ID != invite.ID {
+		t.Fatalf("expected invite to still be pending, got %+v", invites)
+	}
+
+	redeemed, err := store.RedeemInvite(ctx, code, "newbie", "password")
+	if err != nil {
+		t.Fatalf("redeeming invite: %s", err)
+	}
+	if redeemed.ID != invite.ID {
+		t.Errorf("expected invite %s, got %s", invite.ID, redeemed.ID)
+	}
+	if user, ok := store.GetUser("newbie"); !ok || user.Level != ULStreamer {
+		t.Errorf("expected newbie to be created as streamer, got %+v", user)
+	}
+
+	// Invites can only be used once
+	if _, err := store.RedeemInvite(ctx, code, "another", "password"); err != ErrInvalidInvite {
+		t.Errorf("expected invite to be used up, got %v", err)
+	}
+	if _, ok := store.GetUser("another"); ok {
+		t.Error("expected no user to be created with a used invite")
+	}
+	invites, err = store.ListInvites(ctx)
+	if err != nil {
+		t.Fatalf("listing invites: %s", err)
+	}
+	if len(invites) != 0 {
+		t.Errorf("expected no pending invites, got %+v", invites)
+	}
+}
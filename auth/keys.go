@@ -0,0 +1,381 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	kv "github.com/strimertul/kilovolt/v8"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrUnknownSigningKey = errors.New("unknown signing key")
+	ErrNoSigningKey      = errors.New("no active signing key")
+	ErrUnknownAlgorithm  = errors.New("unknown signing algorithm")
+)
+
+// Supported signing algorithms
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+)
+
+// ValidAlgorithm returns true if alg is a supported signing algorithm
+func ValidAlgorithm(alg string) bool {
+	switch alg {
+	case AlgHS256, AlgRS256, AlgEdDSA:
+		return true
+	}
+	return false
+}
+
+// Default grace period for keys replaced automatically
+const defaultRotationGrace = time.Hour * 24 * 7
+
+const keyringKey = "stulbe-auth/keys"
+
+// Legacy single secret, replaced by the key ring
+const legacySecretKey = "stulbe-auth/secret"
+
+// SigningKey is a key used to sign and verify tokens
+type SigningKey struct {
+	ID string `json:"id"`
+	// Algorithm is the JWT algorithm, keys without one are HS256
+	Algorithm string `json:"alg,omitempty"`
+	// Secret holds the HMAC key for HS256 keys
+	Secret []byte `json:"secret,omitempty"`
+	// PrivateKey holds the PKCS #8 encoded private key for asymmetric keys
+	PrivateKey []byte     `json:"private_key,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	RetiresAt  *time.Time `json:"retires_at,omitempty"`
+
+	signer crypto.Signer
+}
+
+// Alg returns the key's JWT algorithm
+func (k SigningKey) Alg() string {
+	if k.Algorithm == "" {
+		return AlgHS256
+	}
+	return k.Algorithm
+}
+
+// Asymmetric returns true if the key has a public part that can be shared
+func (k SigningKey) Asymmetric() bool {
+	return k.Alg() != AlgHS256
+}
+
+func (k *SigningKey) load() error {
+	if !k.Asymmetric() {
+		return nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(k.PrivateKey)
+	if err != nil {
+		return err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return ErrUnknownAlgorithm
+	}
+	k.signer = signer
+	return nil
+}
+
+func (k SigningKey) method() jwt.SigningMethod {
+	return jwt.GetSigningMethod(k.Alg())
+}
+
+func (k SigningKey) signingKey() interface{} {
+	if k.Asymmetric() {
+		return k.signer
+	}
+	return k.Secret
+}
+
+func (k SigningKey) verificationKey() interface{} {
+	if k.Asymmetric() {
+		return k.signer.Public()
+	}
+	return k.Secret
+}
+
+// Retired returns true if the key can't be used to verify tokens anymore
+func (k SigningKey) Retired(now time.Time) bool {
+	return k.RetiresAt != nil && !k.RetiresAt.After(now)
+}
+
+// KeyRing is a list of signing keys, the last one is the active key used
+// for signing new tokens while the others are only kept for verification
+type KeyRing []SigningKey
+
+func newSigningKey(alg string) (SigningKey, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return SigningKey{}, err
+	}
+	key := SigningKey{
+		ID:        id,
+		Algorithm: alg,
+		CreatedAt: time.Now(),
+	}
+
+	var private interface{}
+	switch alg {
+	case AlgHS256:
+		key.Secret = make([]byte, 32)
+		_, err = rand.Read(key.Secret)
+		return key, err
+	case AlgRS256:
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case AlgEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return SigningKey{}, ErrUnknownAlgorithm
+	}
+	if err != nil {
+		return SigningKey{}, err
+	}
+
+	key.PrivateKey, err = x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return SigningKey{}, err
+	}
+	return key, key.load()
+}
+
+func (db *Storage) loadKeyRing(ctx context.Context) error {
+	var ring KeyRing
+	err := db.db.GetJSON(ctx, keyringKey, &ring)
+	if err != nil {
+		return err
+	}
+	for i := range ring {
+		err = ring[i].load()
+		if err != nil {
+			return err
+		}
+	}
+
+	db.keyMu.Lock()
+	db.keys = ring
+	db.keyMu.Unlock()
+	return nil
+}
+
+// resetKeyRing replaces all keys with a new one, invalidating every token
+func (db *Storage) resetKeyRing(ctx context.Context) error {
+	key, err := newSigningKey(db.algorithm)
+	if err != nil {
+		return err
+	}
+
+	db.keyMu.Lock()
+	defer db.keyMu.Unlock()
+
+	db.keys = KeyRing{key}
+	err = db.db.PutJSON(ctx, keyringKey, db.keys)
+	if err != nil {
+		return err
+	}
+
+	// Remove the legacy secret if it's still around
+	_, err = db.db.GetKey(ctx, legacySecretKey)
+	if err == nil {
+		err = db.db.RemoveKey(ctx, legacySecretKey)
+	}
+	if err != nil && err != kv.ErrorKeyNotFound {
+		return err
+	}
+
+	db.logger.Info("generated new key ring", zap.String("kid", key.ID), zap.String("alg", key.Alg()))
+	return nil
+}
+
+// importLegacySecret starts a key ring with the secret used before key rings
+// existed and rotates it out, so that it keeps verifying tokens for the grace
+// period. Returns kv.ErrorKeyNotFound if there is no legacy secret.
+func (db *Storage) importLegacySecret(ctx context.Context) error {
+	hexkey, err := db.db.GetKey(ctx, legacySecretKey)
+	if err != nil {
+		return err
+	}
+	secret, err := hex.DecodeString(hexkey)
+	if err != nil {
+		return err
+	}
+	if len(secret) < 1 {
+		return kv.ErrorKeyNotFound
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return err
+	}
+	key := SigningKey{
+		ID:        id,
+		Algorithm: AlgHS256,
+		Secret:    secret,
+		CreatedAt: time.Now(),
+	}
+
+	db.keyMu.Lock()
+	err = db.db.PutJSON(ctx, keyringKey, KeyRing{key})
+	if err == nil {
+		db.keys = KeyRing{key}
+	}
+	db.keyMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// The secret lives in the key ring now
+	err = db.db.RemoveKey(ctx, legacySecretKey)
+	if err != nil {
+		return err
+	}
+	db.logger.Info("imported legacy secret into key ring", zap.String("kid", key.ID))
+
+	_, err = db.RotateKey(ctx, defaultRotationGrace)
+	return err
+}
+
+// RotateKey creates a new active signing key, the previously active key will
+// keep verifying tokens for the given grace period
+func (db *Storage) RotateKey(ctx context.Context, grace time.Duration) (SigningKey, error) {
+	key, err := newSigningKey(db.algorithm)
+	if err != nil {
+		return SigningKey{}, err
+	}
+
+	db.keyMu.Lock()
+	defer db.keyMu.Unlock()
+
+	now := time.Now()
+	retiresAt := now.Add(grace)
+	ring := KeyRing{}
+	for _, old := range db.keys {
+		// Drop keys that are already retired
+		if old.Retired(now) {
+			continue
+		}
+		if old.RetiresAt == nil || old.RetiresAt.After(retiresAt) {
+			old.RetiresAt = &retiresAt
+		}
+		ring = append(ring, old)
+	}
+	ring = append(ring, key)
+
+	err = db.db.PutJSON(ctx, keyringKey, ring)
+	if err != nil {
+		return SigningKey{}, err
+	}
+	db.keys = ring
+
+	db.logger.Info("rotated signing key", zap.String("kid", key.ID), zap.String("alg", key.Alg()), zap.Duration("grace", grace))
+	return key, nil
+}
+
+// ListKeys returns all signing keys that can still verify tokens
+func (db *Storage) ListKeys() []SigningKey {
+	db.keyMu.RLock()
+	defer db.keyMu.RUnlock()
+
+	now := time.Now()
+	out := []SigningKey{}
+	for _, key := range db.keys {
+		if !key.Retired(now) {
+			out = append(out, key)
+		}
+	}
+	return out
+}
+
+// sign creates a signed token with the active key
+func (db *Storage) sign(claims UserClaims) (string, error) {
+	key, err := db.activeKey()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(key.method(), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.signingKey())
+}
+
+func (db *Storage) activeKey() (SigningKey, error) {
+	db.keyMu.RLock()
+	defer db.keyMu.RUnlock()
+
+	if len(db.keys) < 1 {
+		return SigningKey{}, ErrNoSigningKey
+	}
+	return db.keys[len(db.keys)-1], nil
+}
+
+func (db *Storage) verificationKey(id string) (SigningKey, error) {
+	db.keyMu.RLock()
+	defer db.keyMu.RUnlock()
+
+	now := time.Now()
+	for _, key := range db.keys {
+		if key.ID == id && !key.Retired(now) {
+			return key, nil
+		}
+	}
+	return SigningKey{}, ErrUnknownSigningKey
+}
+
+// JWK is a JSON Web Key (RFC 7517) holding the public part of a signing key
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+}
+
+// JWKSet is a set of JSON Web Keys
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys of all asymmetric keys that can verify tokens
+func (db *Storage) JWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range db.ListKeys() {
+		if !key.Asymmetric() {
+			continue
+		}
+		jwk := JWK{
+			Use:       "sig",
+			KeyID:     key.ID,
+			Algorithm: key.Alg(),
+		}
+		switch public := key.signer.Public().(type) {
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
@@ -0,0 +1,211 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/hex"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	kv "github.com/strimertul/kilovolt/v8"
+	"go.uber.org/zap"
+
+	"github.com/strimertul/stulbe/internal/dbtest"
+)
+
+func TestImportLegacySecret(t *testing.T) {
+	ctx := context.Background()
+	secret := bytes.Repeat([]byte{0x42}, 32)
+	db := dbtest.NewWithData(t, map[string]string{
+		legacySecretKey: hex.EncodeToString(secret),
+	})
+	store, err := Init(ctx, db, Options{Logger: zap.NewNop()})
+	if err != nil {
+		t.Fatalf("could not create auth storage: %s", err)
+	}
+
+	// The legacy secret becomes a key of its own that retires after the grace period
+	keys := store.ListKeys()
+	if len(keys) != 2 {
+		t.Fatalf("expected the legacy key and a new one, got %d keys", len(keys))
+	}
+	legacy, active := keys[0], keys[1]
+	if legacy.Alg() != AlgHS256 || !bytes.Equal(legacy.Secret, secret) || legacy.ID == "" {
+		t.Errorf("expected the legacy secret as an HS256 key, got %+v", legacy)
+	}
+	if legacy.RetiresAt == nil || legacy.RetiresAt.After(time.Now().Add(defaultRotationGrace)) {
+		t.Errorf("expected the legacy key to retire within the grace period, got %v", legacy.RetiresAt)
+	}
+	if active.ID == legacy.ID || bytes.Equal(active.Secret, secret) {
+		t.Error("expected new tokens to be signed with a new key")
+	}
+	if _, err := store.verificationKey(legacy.ID); err != nil {
+		t.Errorf("expected the legacy key to verify tokens, got %v", err)
+	}
+	if _, err := db.GetKey(ctx, legacySecretKey); err != kv.ErrorKeyNotFound {
+		t.Errorf("expected the legacy secret to be removed, got %v", err)
+	}
+
+	// Starting again loads the same ring
+	reloaded, err := Init(ctx, db, Options{Logger: zap.NewNop()})
+	if err != nil {
+		t.Fatalf("could not create auth storage: %s", err)
+	}
+	if keys := reloaded.ListKeys(); len(keys) != 2 || keys[0].ID != legacy.ID || keys[1].ID != active.ID {
+		t.Errorf("expected the same key ring after restarting, got %+v", keys)
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStorage(t)
+
+	if err := store.CreateUser(ctx, "streamer", "password", ULStreamer); err != nil {
+		t.Fatalf("creating user: %s", err)
+	}
+	login := func() string {
+		_, token, err := store.Authenticate(ctx, "streamer", "password", "", jwt.StandardClaims{}, SessionInfo{})
+		if err != nil {
+			t.Fatalf("logging in: %s", err)
+		}
+		return token
+	}
+	kid := func(token string) string {
+		parsed, _, err := new(jwt.Parser).ParseUnverified(token, &UserClaims{})
+		if err != nil {
+			t.Fatalf("parsing token: %s", err)
+		}
+		id, _ := parsed.Header["kid"].(string)
+		return id
+	}
+
+	before := login()
+	key, err := store.RotateKey(ctx, time.Hour)
+	if err != nil {
+		t.Fatalf("rotating key: %s", err)
+	}
+
+	// Old tokens keep working during the grace period, new ones use the new key
+	if _, err := store.Verify(ctx, before); err != nil {
+		t.Errorf("expected old token to verify during the grace period, got %v", err)
+	}
+	after := login()
+	if kid(after) != key.ID || kid(before) == key.ID {
+		t.Errorf("expected only new tokens to be signed with %s", key.ID)
+	}
+	if _, err := store.Verify(ctx, after); err != nil {
+		t.Errorf("verifying new token: %s", err)
+	}
+
+	// Without a grace period the replaced keys stop verifying right away
+	if _, err := store.RotateKey(ctx, 0); err != nil {
+		t.Fatalf("rotating key: %s", err)
+	}
+	for _, token := range []string{before, after} {
+		_, err := store.Verify(ctx, token)
+		if ve, ok := err.(*jwt.ValidationError); !ok || ve.Inner != ErrUnknownSigningKey {
+			t.Errorf("expected token signed with %s to be refused, got %v", kid(token), err)
+		}
+	}
+	if keys := store.ListKeys(); len(keys) != 1 {
+		t.Errorf("expected only the active key to be listed, got %d", len(keys))
+	}
+}
+
+// jwkPublicKey rebuilds the public key a JWK was made from
+func jwkPublicKey(t *testing.T, jwk JWK) interface{} {
+	t.Helper()
+	decode := func(value string) []byte {
+		byt, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil {
+			t.Fatalf("decoding %s key %s: %s", jwk.KeyType, jwk.KeyID, err)
+		}
+		return byt
+	}
+	switch jwk.KeyType {
+	case "OKP":
+		return ed25519.PublicKey(decode(jwk.X))
+	case "RSA":
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(decode(jwk.N)),
+			E: int(new(big.Int).SetBytes(decode(jwk.E)).Int64()),
+		}
+	}
+	t.Fatalf("unexpected key type %s", jwk.KeyType)
+	return nil
+}
+
+func TestJWKS(t *testing.T) {
+	ctx := context.Background()
+	db := dbtest.New(t)
+	claims := UserClaims{
+		User:  "streamer",
+		Level: ULStreamer,
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		},
+	}
+
+	// HMAC keys are secret and never published
+	store, err := Init(ctx, db, Options{Logger: zap.NewNop()})
+	if err != nil {
+		t.Fatalf("could not create auth storage: %s", err)
+	}
+	if set := store.JWKS(); len(set.Keys) != 0 {
+		t.Fatalf("expected no public keys, got %+v", set.Keys)
+	}
+
+	// Changing algorithm rotates the key, both asymmetric keys are published
+	// while the first one is in its grace period
+	tokens := make(map[string]string)
+	for _, alg := range []string{AlgEdDSA, AlgRS256} {
+		store, err = Init(ctx, db, Options{Logger: zap.NewNop(), SigningAlgorithm: alg})
+		if err != nil {
+			t.Fatalf("could not create %s auth storage: %s", alg, err)
+		}
+		tokens[alg], err = store.sign(claims)
+		if err != nil {
+			t.Fatalf("signing %s token: %s", alg, err)
+		}
+	}
+	set := store.JWKS()
+	if len(set.Keys) != 2 {
+		t.Fatalf("expected 2 public keys, got %+v", set.Keys)
+	}
+	expectedTypes := map[string]string{AlgEdDSA: "OKP", AlgRS256: "RSA"}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "sig" || jwk.KeyType != expectedTypes[jwk.Algorithm] {
+			t.Errorf("unexpected key %+v", jwk)
+		}
+	}
+
+	// Tokens can be verified with the published keys alone
+	for alg, token := range tokens {
+		_, err := jwt.ParseWithClaims(token, &UserClaims{}, func(token *jwt.Token) (interface{}, error) {
+			kid, _ := token.Header["kid"].(string)
+			for _, jwk := range set.Keys {
+				if jwk.KeyID == kid && jwk.Algorithm == token.Method.Alg() {
+					return jwkPublicKey(t, jwk), nil
+				}
+			}
+			return nil, ErrUnknownSigningKey
+		})
+		if err != nil {
+			t.Errorf("verifying %s token with the published keys: %s", alg, err)
+		}
+	}
+
+	// Retired keys aren't published anymore
+	key, err := store.RotateKey(ctx, 0)
+	if err != nil {
+		t.Fatalf("rotating key: %s", err)
+	}
+	if set := store.JWKS(); len(set.Keys) != 1 || set.Keys[0].KeyID != key.ID {
+		t.Errorf("expected only %s to be published, got %+v", key.ID, set.Keys)
+	}
+}
@@ -0,0 +1,212 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	kv "github.com/strimertul/kilovolt/v8"
+	"go.uber.org/zap"
+)
+
+const lockoutPrefix = "stulbe-auth/lockouts/"
+
+type LockoutKind string
+
+const (
+	LockoutUser LockoutKind = "user"
+	LockoutIP   LockoutKind = "ip"
+)
+
+// Valid returns true if the kind is one of the known lockout kinds
+func (k LockoutKind) Valid() bool {
+	return k == LockoutUser || k == LockoutIP
+}
+
+const (
+	// Failures allowed before a user gets locked out
+	lockoutUserThreshold = 5
+	// Failures allowed before an address gets locked out, higher since
+	// multiple users can share the same address
+	lockoutIPThreshold = 20
+	// Lock duration after reaching the threshold, doubles with every failure
+	lockoutBaseDuration = 30 * time.Second
+	// Maximum lock duration
+	lockoutMaxDuration = time.Hour
+	// Failures are forgotten after this long without new ones
+	lockoutResetAfter = 24 * time.Hour
+)
+
+// Lockout tracks failed authentication attempts for a user or address
+type Lockout struct {
+	Kind        LockoutKind `json:"kind"`
+	ID          string      `json:"id"`
+	Failures    int         `json:"failures"`
+	LastFailure time.Time   `json:"last_failure"`
+	LockedUntil time.Time   `json:"locked_until"`
+}
+
+// LockoutError is returned when authentication is attempted during a lockout
+type LockoutError struct {
+	Kind  LockoutKind
+	Until time.Time
+}
+
+func (e *LockoutError) Error() string {
+	return fmt.Sprintf("too many failed attempts for %s, locked until %s", e.Kind, e.Until.Format(time.RFC3339))
+}
+
+// RetryAfter returns how long the client should wait before retrying
+func (e *LockoutError) RetryAfter() time.Duration {
+	return time.Until(e.Until)
+}
+
+func lockoutKey(kind LockoutKind, id string) string {
+	return lockoutPrefix + string(kind) + "/" + id
+}
+
+func lockoutThreshold(kind LockoutKind) int {
+	if kind == LockoutIP {
+		return lockoutIPThreshold
+	}
+	return lockoutUserThreshold
+}
+
+// lockoutDuration returns how long to lock out after the given number of
+// consecutive failures, zero if the threshold hasn't been reached yet
+func lockoutDuration(kind LockoutKind, failures int) time.Duration {
+	threshold := lockoutThreshold(kind)
+	if failures < threshold {
+		return 0
+	}
+	// Avoid overflowing the shift, anything past this is over the max anyway
+	if exp := failures - threshold; exp < 16 {
+		if duration := lockoutBaseDuration << uint(exp); duration < lockoutMaxDuration {
+			return duration
+		}
+	}
+	return lockoutMaxDuration
+}
+
+func (db *Storage) getLockout(ctx context.Context, kind LockoutKind, id string) (Lockout, error) {
+	lockout := Lockout{Kind: kind, ID: id}
+	err := db.db.GetJSON(ctx, lockoutKey(kind, id), &lockout)
+	if err != nil && err != kv.ErrorKeyNotFound {
+		return lockout, err
+	}
+	// Forget old failures
+	if time.Since(lockout.LastFailure) > lockoutResetAfter {
+		lockout.Failures = 0
+	}
+	return lockout, nil
+}
+
+// checkLockout returns a LockoutError if the user or address is locked out
+func (db *Storage) checkLockout(ctx context.Context, kind LockoutKind, id string) error {
+	if id == "" {
+		return nil
+	}
+	lockout, err := db.getLockout(ctx, kind, id)
+	if err != nil {
+		return err
+	}
+	if lockout.LockedUntil.After(time.Now()) {
+		return &LockoutError{Kind: kind, Until: lockout.LockedUntil}
+	}
+	return nil
+}
+
+// recordFailure counts a failed attempt, locking out with exponential backoff
+// once the threshold is reached
+func (db *Storage) recordFailure(ctx context.Context, kind LockoutKind, id string) error {
+	if id == "" {
+		return nil
+	}
+
+	// Concurrent failures must all be counted, so update the record atomically
+	var lockout Lockout
+	var duration time.Duration
+	err := db.db.UpdateJSON(ctx, lockoutKey(kind, id), &lockout, func(found bool) error {
+		now := time.Now()
+		lockout.Kind = kind
+		lockout.ID = id
+		// Forget old failures
+		if time.Since(lockout.LastFailure) > lockoutResetAfter {
+			lockout.Failures = 0
+		}
+		lockout.Failures++
+		lockout.LastFailure = now
+
+		duration = lockoutDuration(kind, lockout.Failures)
+		if duration > 0 {
+			lockout.LockedUntil = now.Add(duration)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Failures are forgotten after a while anyway, so the record can go then
+	err = db.db.Expire(ctx, lockoutKey(kind, id), lockoutResetAfter)
+	if err != nil {
+		return err
+	}
+
+	if duration > 0 {
+		db.logger.Warn("too many failed attempts, locking out", zap.String("kind", string(kind)), zap.String("id", id), zap.Int("failures", lockout.Failures), zap.Duration("duration", duration))
+	}
+	return nil
+}
+
+// loginSucceeded forgets previous failures for a user, it must only be called
+// once every step of the login (including one-time codes) passed
+func (db *Storage) loginSucceeded(ctx context.Context, username string) error {
+	err := db.ClearLockout(ctx, LockoutUser, username)
+	if err != nil && err != kv.ErrorKeyNotFound {
+		return err
+	}
+	return nil
+}
+
+// ClearLockout removes failed attempts and locks for a user or address
+func (db *Storage) ClearLockout(ctx context.Context, kind LockoutKind, id string) error {
+	_, err := db.db.GetKey(ctx, lockoutKey(kind, id))
+	if err != nil {
+		return err
+	}
+	return db.db.RemoveKey(ctx, lockoutKey(kind, id))
+}
+
+// ListLockouts returns all users and addresses with recent failed attempts
+func (db *Storage) ListLockouts(ctx context.Context) ([]Lockout, error) {
+	data, err := db.db.GetAll(ctx, lockoutPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	lockouts := []Lockout{}
+	for key, value := range data {
+		if value == "" {
+			continue
+		}
+		var lockout Lockout
+		err := json.Unmarshal([]byte(value), &lockout)
+		if err != nil {
+			db.logger.Warn("skipping invalid lockout record", zap.String("key", key), zap.Error(err))
+			continue
+		}
+		if time.Since(lockout.LastFailure) > lockoutResetAfter {
+			continue
+		}
+		lockouts = append(lockouts, lockout)
+	}
+
+	sort.Slice(lockouts, func(i, j int) bool {
+		if lockouts[i].Kind != lockouts[j].Kind {
+			return lockouts[i].Kind < lockouts[j].Kind
+		}
+		return lockouts[i].ID < lockouts[j].ID
+	})
+	return lockouts, nil
+}
@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/strimertul/stulbe/internal/dbtest"
+)
+
+// newTestStorage returns an auth storage backed by an in-memory database
+func newTestStorage(t *testing.T) *Storage {
+	t.Helper()
+
+	store, err := Init(context.Background(), dbtest.New(t), Options{Logger: zap.NewNop()})
+	if err != nil {
+		t.Fatalf("could not create auth storage: %s", err)
+	}
+	return store
+}
+
+func TestLockoutDuration(t *testing.T) {
+	tests := []struct {
+		kind     LockoutKind
+		failures int
+		expected time.Duration
+	}{
+		{LockoutUser, 1, 0},
+		{LockoutUser, 4, 0},
+		{LockoutUser, 5, 30 * time.Second},
+		{LockoutUser, 6, time.Minute},
+		{LockoutUser, 7, 2 * time.Minute},
+		{LockoutUser, 11, 32 * time.Minute},
+		// Would be 64 minutes, capped to an hour
+		{LockoutUser, 12, time.Hour},
+		{LockoutUser, 100, time.Hour},
+		{LockoutIP, 19, 0},
+		{LockoutIP, 20, 30 * time.Second},
+		{LockoutIP, 21, time.Minute},
+	}
+	for _, test := range tests {
+		if duration := lockoutDuration(test.kind, test.failures); duration != test.expected {
+			t.Errorf("%s after %d failures: expected %s, got %s", test.kind, test.failures, test.expected, duration)
+		}
+	}
+}
+
+func TestRecordFailure(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStorage(t)
+
+	for i := 1; i < lockoutUserThreshold; i++ {
+		if err := store.recordFailure(ctx, LockoutUser, "alice"); err != nil {
+			t.Fatalf("recording failure: %s", err)
+		}
+		if err := store.checkLockout(ctx, LockoutUser, "alice"); err != nil {
+			t.Fatalf("expected no lockout after %d failures, got %v", i, err)
+		}
+	}
+
+	// Reaching the threshold locks out for the base duration, then it doubles
+	for _, expected := range []time.Duration{lockoutBaseDuration, 2 * lockoutBaseDuration} {
+		before := time.Now()
+		if err := store.recordFailure(ctx, LockoutUser, "alice"); err != nil {
+			t.Fatalf("recording failure: %s", err)
+		}
+		err := store.checkLockout(ctx, LockoutUser, "alice")
+		lockout, ok := err.(*LockoutError)
+		if !ok {
+			t.Fatalf("expected a lockout error, got %v", err)
+		}
+		if lockout.Until.Before(before.Add(expected)) || lockout.Until.After(time.Now().Add(expected)) {
+			t.Errorf("expected a lockout of %s, locked until %s", expected, lockout.Until)
+		}
+	}
+
+	// Other users and addresses are not affected
+	if err := store.checkLockout(ctx, LockoutUser, "bob"); err != nil {
+		t.Errorf("expected no lockout for another user, got %v", err)
+	}
+	if err := store.checkLockout(ctx, LockoutIP, "alice"); err != nil {
+		t.Errorf("expected no lockout for an address, got %v", err)
+	}
+
+	if err := store.ClearLockout(ctx, LockoutUser, "alice"); err != nil {
+		t.Fatalf("clearing lockout: %s", err)
+	}
+	if err := store.checkLockout(ctx, LockoutUser, "alice"); err != nil {
+		t.Errorf("expected no lockout after clearing, got %v", err)
+	}
+}
+
+func TestLockoutReset(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStorage(t)
+
+	// Lots of failures, but the last one was more than a day ago
+	lastFailure := time.Now().Add(-lockoutResetAfter - time.Minute)
+	err := store.db.PutJSON(ctx, lockoutKey(LockoutUser, "alice"), Lockout{
+		Kind:        LockoutUser,
+		ID:          "alice",
+		Failures:    50,
+		LastFailure: lastFailure,
+		LockedUntil: lastFailure.Add(lockoutMaxDuration),
+	})
+	if err != nil {
+		t.Fatalf("writing lockout: %s", err)
+	}
+
+	lockout, err := store.getLockout(ctx, LockoutUser, "alice")
+	if err != nil {
+		t.Fatalf("reading lockout: %s", err)
+	}
+	if lockout.Failures != 0 {
+		t.Errorf("expected old failures to be forgotten, got %d", lockout.Failures)
+	}
+
+	// A new failure starts counting from scratch instead of locking out for the max
+	if err := store.recordFailure(ctx, LockoutUser, "alice"); err != nil {
+		t.Fatalf("recording failure: %s", err)
+	}
+	if err := store.checkLockout(ctx, LockoutUser, "alice"); err != nil {
+		t.Errorf("expected no lockout after a single recent failure, got %v", err)
+	}
+	lockout, err = store.getLockout(ctx, LockoutUser, "alice")
+	if err != nil {
+		t.Fatalf("reading lockout: %s", err)
+	}
+	if lockout.Failures != 1 {
+		t.Errorf("expected 1 failure, got %d", lockout.Failures)
+	}
+}
@@ -0,0 +1,180 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	kv "github.com/strimertul/kilovolt/v8"
+	"go.uber.org/zap"
+
+	"github.com/strimertul/stulbe/database"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token already used")
+)
+
+const refreshTokenPrefix = "stulbe-auth/refresh/"
+
+const (
+	// DefaultTokenLifetime is how long access tokens are valid for when no
+	// lifetime is configured for the user's level
+	DefaultTokenLifetime = time.Hour * 24 * 7
+	// DefaultRefreshLifetime is how long refresh tokens are valid for
+	DefaultRefreshLifetime = time.Hour * 24 * 30
+)
+
+// RefreshToken is a single-use credential for getting a new access token for
+// a session. Used tokens are kept until they expire so that reusing one (which
+// means it was stolen) can be detected and the session revoked.
+type RefreshToken struct {
+	User      string    `json:"user"`
+	SessionID string    `json:"session"`
+	Used      bool      `json:"used"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// TokenLifetime returns how long access tokens for the given level are valid for
+func (db *Storage) TokenLifetime(level UserLevel) time.Duration {
+	if lifetime, ok := db.tokenLifetimes[level]; ok {
+		return lifetime
+	}
+	return DefaultTokenLifetime
+}
+
+// MaxTokenLifetime returns the longest lifetime of access tokens for any level
+func (db *Storage) MaxTokenLifetime() time.Duration {
+	max := DefaultTokenLifetime
+	for _, lifetime := range db.tokenLifetimes {
+		if lifetime > max {
+			max = lifetime
+		}
+	}
+	return max
+}
+
+// CreateRefreshToken issues a refresh token for the session of a token,
+// extending the session so that it lasts as long as the refresh token
+func (db *Storage) CreateRefreshToken(ctx context.Context, claims UserClaims) (string, time.Time, error) {
+	session, err := db.GetSession(ctx, claims.User, claims.Id)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return db.createRefreshToken(ctx, session)
+}
+
+func (db *Storage) createRefreshToken(ctx context.Context, session Session) (string, time.Time, error) {
+	token, err := randomHex(32)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(db.refreshLifetime)
+	err = db.db.PutJSONTTL(ctx, refreshTokenPrefix+hashToken(token), RefreshToken{
+		User:      session.User,
+		SessionID: session.ID,
+		CreatedAt: now,
+		ExpiresAt: expiresAt,
+	}, db.refreshLifetime)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	if session.ExpiresAt.Before(expiresAt) {
+		session.ExpiresAt = expiresAt
+		err = db.saveSession(ctx, session)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+	}
+	return token, expiresAt, nil
+}
+
+// Refresh consumes a refresh token and issues a new access token and refresh
+// token for the same session. Reusing a refresh token revokes the session.
+func (db *Storage) Refresh(ctx context.Context, token string) (UserClaims, string, string, error) {
+	key := refreshTokenPrefix + hashToken(token)
+
+	var data RefreshToken
+	version, err := db.getVersionedJSON(ctx, key, &data)
+	if err != nil {
+		if err == kv.ErrorKeyNotFound {
+			return UserClaims{}, "", "", ErrInvalidRefreshToken
+		}
+		return UserClaims{}, "", "", err
+	}
+
+	now := time.Now()
+	if data.ExpiresAt.Before(now) {
+		err = db.db.RemoveKey(ctx, key)
+		if err != nil {
+			return UserClaims{}, "", "", err
+		}
+		return UserClaims{}, "", "", ErrInvalidRefreshToken
+	}
+
+	// Used tokens are kept until they expire to detect reuse, if the token
+	// changed since it was read someone else used it concurrently
+	reused := data.Used
+	if !reused {
+		data.Used = true
+		byt, err := json.Marshal(data)
+		if err != nil {
+			return UserClaims{}, "", "", err
+		}
+		err = db.db.CompareAndSwapTTL(ctx, key, version, string(byt), data.ExpiresAt.Sub(now))
+		if err != nil && err != database.ErrVersionMismatch {
+			return UserClaims{}, "", "", err
+		}
+		reused = err == database.ErrVersionMismatch
+	}
+
+	if reused {
+		db.logger.Warn("refresh token reused, revoking session", zap.String("user", data.User), zap.String("session", data.SessionID))
+		err = db.RevokeSession(ctx, data.User, data.SessionID)
+		if err != nil && err != ErrSessionNotFound {
+			return UserClaims{}, "", "", err
+		}
+		return UserClaims{}, "", "", ErrRefreshTokenReused
+	}
+
+	session, err := db.GetSession(ctx, data.User, data.SessionID)
+	if err != nil {
+		if err == ErrSessionNotFound {
+			return UserClaims{}, "", "", ErrSessionRevoked
+		}
+		return UserClaims{}, "", "", err
+	}
+
+	// Use the current level of the user, it might have changed since login
+	user, ok := db.GetUser(data.User)
+	if !ok {
+		return UserClaims{}, "", "", ErrUserNotFound
+	}
+
+	session.LastSeen = now
+	refreshToken, _, err := db.createRefreshToken(ctx, session)
+	if err != nil {
+		return UserClaims{}, "", "", err
+	}
+
+	claims := UserClaims{
+		User:  user.User,
+		Level: user.Level,
+		StandardClaims: jwt.StandardClaims{
+			Id:        session.ID,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(db.TokenLifetime(user.Level)).Unix(),
+		},
+	}
+	accessToken, err := db.sign(claims)
+	if err != nil {
+		return UserClaims{}, "", "", err
+	}
+	return claims, accessToken, refreshToken, nil
+}
@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestRefresh(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStorage(t)
+
+	if err := store.CreateUser(ctx, "streamer", "password", ULStreamer); err != nil {
+		t.Fatalf("creating user: %s", err)
+	}
+	claims, _, err := store.Authenticate(ctx, "streamer", "password", "", jwt.StandardClaims{}, SessionInfo{})
+	if err != nil {
+		t.Fatalf("logging in: %s", err)
+	}
+	first, _, err := store.CreateRefreshToken(ctx, claims)
+	if err != nil {
+		t.Fatalf("creating refresh token: %s", err)
+	}
+
+	if _, _, _, err := store.Refresh(ctx, "not a token"); err != ErrInvalidRefreshToken {
+		t.Errorf("expected unknown token to be invalid, got %v", err)
+	}
+
+	// Refreshing keeps the session and replaces the refresh token
+	refreshed, accessToken, second, err := store.Refresh(ctx, first)
+	if err != nil {
+		t.Fatalf("refreshing: %s", err)
+	}
+	if refreshed.Id != claims.Id || refreshed.User != "streamer" {
+		t.Errorf("expected a token for the same session, got %+v", refreshed)
+	}
+	if second == first {
+		t.Error("expected a new refresh token")
+	}
+	if _, err := store.Verify(ctx, accessToken); err != nil {
+		t.Fatalf("verifying refreshed token: %s", err)
+	}
+
+	// Using the first token again means it was stolen, the whole session goes
+	if _, _, _, err := store.Refresh(ctx, first); err != ErrRefreshTokenReused {
+		t.Fatalf("expected reused token to be refused, got %v", err)
+	}
+	if _, err := store.GetSession(ctx, "streamer", claims.Id); err != ErrSessionNotFound {
+		t.Errorf("expected session to be revoked, got %v", err)
+	}
+	if _, err := store.Verify(ctx, accessToken); err != ErrSessionRevoked {
+		t.Errorf("expected refreshed token to be revoked, got %v", err)
+	}
+	if _, _, _, err := store.Refresh(ctx, second); err != ErrSessionRevoked {
+		t.Errorf("expected the latest refresh token to stop working, got %v", err)
+	}
+}
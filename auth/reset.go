@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	kv "github.com/strimertul/kilovolt/v8"
+)
+
+var (
+	ErrInvalidResetToken = errors.New("invalid or expired reset token")
+)
+
+const resetTokenPrefix = "stulbe-auth/reset-tokens/"
+
+// ResetToken allows a user to set a new auth key without knowing the old one
+type ResetToken struct {
+	User      string    `json:"user"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ChangeKey replaces a user's key after checking the current one
+func (db *Storage) ChangeKey(ctx context.Context, username string, oldKey string, newKey string, ip string) error {
+	_, err := db.CheckKey(ctx, username, oldKey, ip)
+	if err != nil {
+		return err
+	}
+	return db.SetUserKey(ctx, username, newKey)
+}
+
+// CreateResetToken issues a one-time token that can be redeemed to set a new key
+func (db *Storage) CreateResetToken(ctx context.Context, username string, lifetime time.Duration) (string, ResetToken, error) {
+	if _, ok := db.GetUser(username); !ok {
+		return "", ResetToken{}, ErrUserNotFound
+	}
+
+	token, err := randomHex(24)
+	if err != nil {
+		return "", ResetToken{}, err
+	}
+
+	now := time.Now()
+	data := ResetToken{
+		User:      username,
+		CreatedAt: now,
+		ExpiresAt: now.Add(lifetime),
+	}
+	return token, data, db.db.PutJSONTTL(ctx, resetTokenPrefix+hashToken(token), data, lifetime)
+}
+
+// RedeemResetToken consumes a reset token and sets the user's new key,
+// returning the name of the user the token was for
+func (db *Storage) RedeemResetToken(ctx context.Context, token string, newKey string) (string, error) {
+	if newKey == "" {
+		return "", ErrInvalidKey
+	}
+	key := resetTokenPrefix + hashToken(token)
+
+	var data ResetToken
+	err := db.consumeJSON(ctx, key, &data)
+	if err != nil {
+		if err == kv.ErrorKeyNotFound {
+			return "", ErrInvalidResetToken
+		}
+		return "", err
+	}
+
+	if data.ExpiresAt.Before(time.Now()) {
+		return "", ErrInvalidResetToken
+	}
+
+	return data.User, db.SetUserKey(ctx, data.User, newKey)
+}
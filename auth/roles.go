@@ -0,0 +1,67 @@
+package auth
+
+// Permission is an action on the API that only some user levels can perform
+type Permission string
+
+const (
+	// PermAccount allows managing one's own account (sessions, API keys, auth key, TOTP)
+	PermAccount Permission = "account"
+	// PermNamespace allows accessing one's own KV namespace
+	PermNamespace Permission = "namespace"
+	// PermTwitchLink allows linking a Twitch account
+	PermTwitchLink Permission = "twitch:link"
+	// PermTwitchRead allows reading data from the linked Twitch account
+	PermTwitchRead Permission = "twitch:read"
+	// PermTwitchSubscriptions allows listing and removing EventSub subscriptions
+	PermTwitchSubscriptions Permission = "twitch:subscriptions"
+	// PermManageUsers allows creating, changing and removing users and their sessions
+	PermManageUsers Permission = "admin:users"
+	// PermManageKeys allows listing and rotating the token signing keys
+	PermManageKeys Permission = "admin:keys"
+	// PermManageInvites allows creating and removing invite codes
+	PermManageInvites Permission = "admin:invites"
+	// PermManageLockouts allows listing and clearing failed login lockouts
+	PermManageLockouts Permission = "admin:lockouts"
+	// PermViewAudit allows reading the audit log
+	PermViewAudit Permission = "admin:audit"
+	// PermManageBackups allows listing and creating database snapshots
+	PermManageBackups Permission = "admin:backups"
+)
+
+// rolePermissions is the permission matrix for each user level
+var rolePermissions = map[UserLevel][]Permission{
+	ULAdmin: {
+		PermAccount, PermNamespace, PermTwitchLink, PermTwitchRead, PermTwitchSubscriptions,
+		PermManageUsers, PermManageKeys, PermManageInvites, PermManageLockouts, PermViewAudit,
+		PermManageBackups,
+	},
+	ULStreamer: {
+		PermAccount, PermNamespace, PermTwitchLink, PermTwitchRead,
+	},
+	ULModerator: {
+		PermAccount,
+	},
+	ULBot: {
+		PermAccount, PermNamespace, PermTwitchRead,
+	},
+}
+
+// Permissions returns all the permissions granted to the level
+func (l UserLevel) Permissions() []Permission {
+	return rolePermissions[l]
+}
+
+// Can returns true if the level grants the permission
+func (l UserLevel) Can(perm Permission) bool {
+	for _, p := range rolePermissions[l] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// Can returns true if the token's user level grants the permission
+func (c *UserClaims) Can(perm Permission) bool {
+	return c.Level.Can(perm)
+}
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	ErrInvalidScope = errors.New("invalid scope")
+)
+
+// Token scopes, tokens without any scope have full access
+const (
+	// ScopeTwitchRead allows reading data from the linked Twitch account
+	ScopeTwitchRead = "twitch:read"
+	// ScopeLoyaltyRPC allows writing loyalty redeem/contribute RPC keys
+	ScopeLoyaltyRPC = "loyalty:rpc"
+	// ScopeKVReadPrefix followed by a key prefix allows reading keys with that prefix
+	ScopeKVReadPrefix = "kv:read:"
+	// ScopeKVWritePrefix followed by a key prefix allows reading and writing keys with that prefix
+	ScopeKVWritePrefix = "kv:write:"
+)
+
+// ValidScope returns true if the scope is a known scope
+func ValidScope(scope string) bool {
+	switch scope {
+	case ScopeTwitchRead, ScopeLoyaltyRPC:
+		return true
+	}
+	return strings.HasPrefix(scope, ScopeKVReadPrefix) || strings.HasPrefix(scope, ScopeKVWritePrefix)
+}
+
+// Scoped returns true if the token is restricted to a set of scopes
+func (c *UserClaims) Scoped() bool {
+	return len(c.Scopes) > 0
+}
+
+// HasScope returns true if the token has the given scope
+func (c *UserClaims) HasScope(scope string) bool {
+	if !c.Scoped() {
+		return true
+	}
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// CanRead returns true if the token can read keys starting with prefix
+// (or the key itself)
+func (c *UserClaims) CanRead(prefix string) bool {
+	if !c.Scoped() {
+		return true
+	}
+	for _, s := range c.Scopes {
+		if granted, ok := kvScopePrefix(s, ScopeKVReadPrefix); ok && strings.HasPrefix(prefix, granted) {
+			return true
+		}
+		if granted, ok := kvScopePrefix(s, ScopeKVWritePrefix); ok && strings.HasPrefix(prefix, granted) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanWrite returns true if the token can write the given key
+func (c *UserClaims) CanWrite(key string) bool {
+	if !c.Scoped() {
+		return true
+	}
+	for _, s := range c.Scopes {
+		if granted, ok := kvScopePrefix(s, ScopeKVWritePrefix); ok && strings.HasPrefix(key, granted) {
+			return true
+		}
+	}
+	return false
+}
+
+func kvScopePrefix(scope string, kind string) (string, bool) {
+	if !strings.HasPrefix(scope, kind) {
+		return "", false
+	}
+	return scope[len(kind):], true
+}
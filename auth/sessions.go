@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	kv "github.com/strimertul/kilovolt/v8"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+)
+
+const sessionsPrefix = "stulbe-auth/sessions/"
+
+// How often a session's last seen timestamp gets written back
+const sessionTouchInterval = time.Minute
+
+// Session is a server-side record of an issued token, tokens without
+// a matching session are rejected even if their signature is valid
+type Session struct {
+	ID        string    `json:"id"`
+	User      string    `json:"user"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	// Name is only set for API keys
+	Name   string   `json:"name,omitempty"`
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// APIKey returns true if the session was created as a named API key
+func (s Session) APIKey() bool {
+	return s.Name != ""
+}
+
+// SessionInfo contains information about the client requesting a session
+type SessionInfo struct {
+	IP        string
+	UserAgent string
+}
+
+func sessionKey(user string, id string) string {
+	return sessionsPrefix + user + "/" + id
+}
+
+// saveSession writes a session record, which is removed once it expires
+func (db *Storage) saveSession(ctx context.Context, session Session) error {
+	return db.db.PutJSONTTL(ctx, sessionKey(session.User, session.ID), session, time.Until(session.ExpiresAt))
+}
+
+func (db *Storage) newSession(user string, info SessionInfo, expiresAt time.Time) (Session, error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return Session{}, err
+	}
+
+	now := time.Now()
+	return Session{
+		ID:        id,
+		User:      user,
+		IP:        info.IP,
+		UserAgent: info.UserAgent,
+		CreatedAt: now,
+		LastSeen:  now,
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+func (db *Storage) createSession(ctx context.Context, user string, info SessionInfo, expiresAt time.Time) (Session, error) {
+	session, err := db.newSession(user, info, expiresAt)
+	if err != nil {
+		return Session{}, err
+	}
+	return session, db.saveSession(ctx, session)
+}
+
+// GetSession retrieves a session by its ID
+func (db *Storage) GetSession(ctx context.Context, user string, id string) (Session, error) {
+	var session Session
+	err := db.db.GetJSON(ctx, sessionKey(user, id), &session)
+	if err != nil {
+		if err == kv.ErrorKeyNotFound {
+			return Session{}, ErrSessionNotFound
+		}
+		return Session{}, err
+	}
+	return session, nil
+}
+
+// ListSessions returns all active sessions for a user, removing expired ones
+func (db *Storage) ListSessions(ctx context.Context, user string) ([]Session, error) {
+	prefix := sessionKey(user, "")
+	data, err := db.db.GetAll(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	sessions := []Session{}
+	for key, value := range data {
+		// Skip keys of other users sharing the same prefix and removed keys
+		if value == "" || strings.Contains(key[len(prefix):], "/") {
+			continue
+		}
+		var session Session
+		err := json.Unmarshal([]byte(value), &session)
+		if err != nil {
+			db.logger.Warn("skipping invalid session record", zap.String("key", key), zap.Error(err))
+			continue
+		}
+		if session.ExpiresAt.Before(now) {
+			err = db.db.RemoveKey(ctx, key)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+	})
+	return sessions, nil
+}
+
+// TouchSession updates the last seen time of a session, writes are
+// throttled so that busy clients don't cause a write on every request
+func (db *Storage) TouchSession(ctx context.Context, claims *UserClaims) error {
+	session, err := db.GetSession(ctx, claims.User, claims.Id)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if now.Sub(session.LastSeen) < sessionTouchInterval {
+		return nil
+	}
+
+	session.LastSeen = now
+	return db.saveSession(ctx, session)
+}
+
+// RevokeSession removes a session, invalidating its token
+func (db *Storage) RevokeSession(ctx context.Context, user string, id string) error {
+	_, err := db.GetSession(ctx, user, id)
+	if err != nil {
+		return err
+	}
+	return db.db.RemoveKey(ctx, sessionKey(user, id))
+}
+
+// RevokeAllSessions removes every session for a user, returning how many were removed
+func (db *Storage) RevokeAllSessions(ctx context.Context, user string) (int, error) {
+	sessions, err := db.ListSessions(ctx, user)
+	if err != nil {
+		return 0, err
+	}
+	for _, session := range sessions {
+		err = db.db.RemoveKey(ctx, sessionKey(user, session.ID))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(sessions), nil
+}
+
+// CreateAPIKey creates a named, long-lived session restricted to the given
+// scopes and returns its token
+func (db *Storage) CreateAPIKey(ctx context.Context, username string, name string, scopes []string, expiresAt time.Time, info SessionInfo) (Session, string, error) {
+	user, ok := db.GetUser(username)
+	if !ok {
+		return Session{}, "", ErrUserNotFound
+	}
+	if len(scopes) < 1 {
+		return Session{}, "", ErrInvalidScope
+	}
+	for _, scope := range scopes {
+		if !ValidScope(scope) {
+			return Session{}, "", ErrInvalidScope
+		}
+	}
+
+	session, err := db.newSession(user.User, info, expiresAt)
+	if err != nil {
+		return Session{}, "", err
+	}
+	session.Name = name
+	session.Scopes = scopes
+	err = db.saveSession(ctx, session)
+	if err != nil {
+		return Session{}, "", err
+	}
+
+	token, err := db.sign(UserClaims{
+		User:   user.User,
+		Level:  user.Level,
+		Scopes: scopes,
+		StandardClaims: jwt.StandardClaims{
+			Id:        session.ID,
+			IssuedAt:  session.CreatedAt.Unix(),
+			ExpiresAt: expiresAt.Unix(),
+		},
+	})
+	return session, token, err
+}
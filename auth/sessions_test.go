@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSessionsExpire(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStorage(t)
+
+	if err := store.CreateUser(ctx, "streamer", "password", ULStreamer); err != nil {
+		t.Fatalf("creating user: %s", err)
+	}
+	expiring, _, err := store.CreateAPIKey(ctx, "streamer", "expiring", []string{ScopeTwitchRead}, time.Now().Add(time.Millisecond), SessionInfo{})
+	if err != nil {
+		t.Fatalf("creating api key: %s", err)
+	}
+	live, _, err := store.CreateAPIKey(ctx, "streamer", "live", []string{ScopeTwitchRead}, time.Now().Add(time.Hour), SessionInfo{})
+	if err != nil {
+		t.Fatalf("creating api key: %s", err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	// Expired records are removed from the database, not just hidden
+	if _, err := store.db.RemoveExpired(ctx); err != nil {
+		t.Fatalf("removing expired keys: %s", err)
+	}
+	if _, err := store.db.GetKey(ctx, sessionKey("streamer", expiring.ID)); err == nil {
+		t.Error("expected the expired session record to be removed")
+	}
+	if _, err := store.GetSession(ctx, "streamer", live.ID); err != nil {
+		t.Errorf("expected the live session to be kept, got %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	kv "github.com/strimertul/kilovolt/v8"
+)
+
+var (
+	ErrInvalidTicket = errors.New("invalid or expired ticket")
+)
+
+const wsTicketPrefix = "stulbe-auth/ws-tickets/"
+
+// How long a websocket ticket can be redeemed for
+const wsTicketLifetime = 30 * time.Second
+
+// WebsocketTicket is a short-lived, single-use credential for opening a
+// websocket connection from clients that can't set headers (eg. browsers)
+type WebsocketTicket struct {
+	User      string    `json:"user"`
+	Level     UserLevel `json:"level"`
+	SessionID string    `json:"session"`
+	Scopes    []string  `json:"scopes,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// hashToken hashes single-use tokens so that they aren't stored in plain text
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// CreateWebsocketTicket issues a ticket with the same user, session and scopes of a token
+func (db *Storage) CreateWebsocketTicket(ctx context.Context, claims *UserClaims) (string, time.Time, error) {
+	ticket, err := randomHex(24)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	expiresAt := time.Now().Add(wsTicketLifetime)
+	err = db.db.PutJSONTTL(ctx, wsTicketPrefix+hashToken(ticket), WebsocketTicket{
+		User:      claims.User,
+		Level:     claims.Level,
+		SessionID: claims.Id,
+		Scopes:    claims.Scopes,
+		ExpiresAt: expiresAt,
+	}, wsTicketLifetime)
+	return ticket, expiresAt, err
+}
+
+// RedeemWebsocketTicket consumes a ticket and returns the claims it was issued for
+func (db *Storage) RedeemWebsocketTicket(ctx context.Context, ticket string) (*UserClaims, error) {
+	key := wsTicketPrefix + hashToken(ticket)
+
+	var data WebsocketTicket
+	err := db.consumeJSON(ctx, key, &data)
+	if err != nil {
+		if err == kv.ErrorKeyNotFound {
+			return nil, ErrInvalidTicket
+		}
+		return nil, err
+	}
+
+	if data.ExpiresAt.Before(time.Now()) {
+		return nil, ErrInvalidTicket
+	}
+
+	// The session that requested the ticket must still be valid
+	session, err := db.GetSession(ctx, data.User, data.SessionID)
+	if err != nil {
+		if err == ErrSessionNotFound {
+			return nil, ErrSessionRevoked
+		}
+		return nil, err
+	}
+
+	// Use the current level of the user, it might have changed since the ticket was issued
+	user, ok := db.GetUser(data.User)
+	if !ok {
+		return nil, ErrSessionRevoked
+	}
+
+	return &UserClaims{
+		User:   user.User,
+		Level:  user.Level,
+		Scopes: data.Scopes,
+		StandardClaims: jwt.StandardClaims{
+			Id:        session.ID,
+			ExpiresAt: session.ExpiresAt.Unix(),
+		},
+	}, nil
+}
@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestRedeemWebsocketTicket(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStorage(t)
+
+	if err := store.CreateUser(ctx, "streamer", "password", ULStreamer); err != nil {
+		t.Fatalf("creating user: %s", err)
+	}
+	claims, _, err := store.Authenticate(ctx, "streamer", "password", "", jwt.StandardClaims{}, SessionInfo{})
+	if err != nil {
+		t.Fatalf("logging in: %s", err)
+	}
+	claims.Scopes = []string{ScopeKVReadPrefix + "overlay/"}
+
+	ticket, _, err := store.CreateWebsocketTicket(ctx, &claims)
+	if err != nil {
+		t.Fatalf("creating ticket: %s", err)
+	}
+
+	// Tickets carry the session and scopes of the token they were made with
+	redeemed, err := store.RedeemWebsocketTicket(ctx, ticket)
+	if err != nil {
+		t.Fatalf("redeeming ticket: %s", err)
+	}
+	if redeemed.User != "streamer" || redeemed.Id != claims.Id || len(redeemed.Scopes) != 1 || redeemed.Scopes[0] != claims.Scopes[0] {
+		t.Errorf("expected claims of the ticket's token, got %+v", redeemed)
+	}
+
+	// Tickets can only be used once
+	if _, err := store.RedeemWebsocketTicket(ctx, ticket); err != ErrInvalidTicket {
+		t.Errorf("expected ticket to be used up, got %v", err)
+	}
+	if _, err := store.RedeemWebsocketTicket(ctx, "not a ticket"); err != ErrInvalidTicket {
+		t.Errorf("expected unknown ticket to be invalid, got %v", err)
+	}
+
+	// Tickets of revoked sessions don't work
+	ticket, _, err = store.CreateWebsocketTicket(ctx, &claims)
+	if err != nil {
+		t.Fatalf("creating ticket: %s", err)
+	}
+	if err := store.RevokeSession(ctx, "streamer", claims.Id); err != nil {
+		t.Fatalf("revoking session: %s", err)
+	}
+	if _, err := store.RedeemWebsocketTicket(ctx, ticket); err != ErrSessionRevoked {
+		t.Errorf("expected ticket of revoked session to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,255 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrOTPRequired        = errors.New("one-time code required")
+	ErrInvalidOTP         = errors.New("invalid one-time code")
+	ErrTOTPNotEnrolled    = errors.New("totp enrollment not started")
+	ErrTOTPAlreadyEnabled = errors.New("totp already enabled")
+	ErrTOTPNotEnabled     = errors.New("totp not enabled")
+)
+
+// RFC 6238 parameters, these are the defaults every authenticator app supports
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// Accept codes from one step before/after to account for clock drift
+	totpSkew = 1
+
+	totpIssuer = "stulbe"
+
+	recoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode computes the code for a secret at the given time step
+func totpCode(secret []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation (RFC 4226 section 5.3)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// checkTOTP returns the time step the code is valid for, or -1 if it isn't valid
+// for any step after lastStep
+func checkTOTP(encodedSecret string, code string, lastStep int64) int64 {
+	secret, err := totpEncoding.DecodeString(encodedSecret)
+	if err != nil {
+		return -1
+	}
+
+	current := time.Now().Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		// Don't accept codes that were already used
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step
+		}
+	}
+	return -1
+}
+
+func totpURI(username string, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + username)
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {totpIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// useOTP checks a one-time code against the user's TOTP secret and recovery
+// codes, updating the user so that the same code can't be used again.
+// Returns ErrInvalidOTP if the code doesn't match.
+func (db *Storage) useOTP(ctx context.Context, username string, code string) error {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if code == "" {
+		return ErrInvalidOTP
+	}
+
+	// TOTP codes are cheap to check, so do it while holding the lock to make
+	// sure concurrent logins can't use the same code twice
+	err := db.updateUser(ctx, username, func(user *User) error {
+		step := checkTOTP(user.TOTPSecret, code, user.TOTPLastStep)
+		if step < 0 {
+			return ErrInvalidOTP
+		}
+		user.TOTPLastStep = step
+		return nil
+	})
+	if err != ErrInvalidOTP {
+		return err
+	}
+
+	// Recovery codes are bcrypt hashes, compare them without holding the lock
+	// and only take it to consume the one that matched
+	user, ok := db.GetUser(username)
+	if !ok {
+		return ErrUserNotFound
+	}
+	var matched []byte
+	for _, hash := range user.RecoveryCodes {
+		if bcrypt.CompareHashAndPassword(hash, []byte(code)) == nil {
+			matched = hash
+			break
+		}
+	}
+	if matched == nil {
+		return ErrInvalidOTP
+	}
+	return db.updateUser(ctx, username, func(user *User) error {
+		for i, hash := range user.RecoveryCodes {
+			if bytes.Equal(hash, matched) {
+				user.RecoveryCodes = append(user.RecoveryCodes[:i:i], user.RecoveryCodes[i+1:]...)
+				return nil
+			}
+		}
+		// Used by a concurrent login
+		return ErrInvalidOTP
+	})
+}
+
+// verifyOTP checks a one-time code for a user with TOTP enabled, failed
+// attempts count towards lockouts
+func (db *Storage) verifyOTP(ctx context.Context, username string, code string, ip string) error {
+	if code == "" {
+		return ErrOTPRequired
+	}
+
+	err := db.useOTP(ctx, username, code)
+	if err == ErrInvalidOTP {
+		if err := db.recordFailure(ctx, LockoutIP, ip); err != nil {
+			return err
+		}
+		if err := db.recordFailure(ctx, LockoutUser, username); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// BeginTOTPEnrollment generates a new TOTP secret for the user, returning it
+// with an otpauth:// URI for authenticator apps. TOTP is enabled only after
+// the first code is confirmed with ConfirmTOTP.
+func (db *Storage) BeginTOTPEnrollment(ctx context.Context, username string) (string, string, error) {
+	raw := make([]byte, 20)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", "", err
+	}
+	secret := totpEncoding.EncodeToString(raw)
+
+	err = db.updateUser(ctx, username, func(user *User) error {
+		if user.TOTPEnabled() {
+			return ErrTOTPAlreadyEnabled
+		}
+		user.TOTPPending = secret
+		return nil
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return secret, totpURI(username, secret), nil
+}
+
+// ConfirmTOTP enables TOTP if the code matches the pending secret and
+// returns a new set of recovery codes
+func (db *Storage) ConfirmTOTP(ctx context.Context, username string, code string) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([][]byte, recoveryCodeCount)
+	for i := range codes {
+		var err error
+		codes[i], err = randomHex(5)
+		if err != nil {
+			return nil, err
+		}
+		hashes[i], err = bcrypt.GenerateFromPassword([]byte(codes[i]), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := db.updateUser(ctx, username, func(user *User) error {
+		if user.TOTPEnabled() {
+			return ErrTOTPAlreadyEnabled
+		}
+		if user.TOTPPending == "" {
+			return ErrTOTPNotEnrolled
+		}
+		step := checkTOTP(user.TOTPPending, code, 0)
+		if step < 0 {
+			return ErrInvalidOTP
+		}
+		user.TOTPSecret = user.TOTPPending
+		user.TOTPPending = ""
+		user.TOTPLastStep = step
+		user.RecoveryCodes = hashes
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTOTP turns off TOTP for a user after checking a code
+func (db *Storage) DisableTOTP(ctx context.Context, username string, code string, ip string) error {
+	user, ok := db.GetUser(username)
+	if !ok {
+		return ErrUserNotFound
+	}
+	if !user.TOTPEnabled() {
+		return ErrTOTPNotEnabled
+	}
+	err := db.verifyOTP(ctx, username, code, ip)
+	if err != nil {
+		return err
+	}
+	return db.ResetTOTP(ctx, username)
+}
+
+// ResetTOTP turns off TOTP for a user without checking a code, for admins
+// helping users that lost both their authenticator and recovery codes
+func (db *Storage) ResetTOTP(ctx context.Context, username string) error {
+	return db.updateUser(ctx, username, func(user *User) error {
+		user.TOTPSecret = ""
+		user.TOTPPending = ""
+		user.TOTPLastStep = 0
+		user.RecoveryCodes = nil
+		return nil
+	})
+}
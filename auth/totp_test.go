@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	kv "github.com/strimertul/kilovolt/v8"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// SHA1 test vectors from RFC 6238 appendix B, truncated to 6 digits
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, test := range tests {
+		if code := totpCode(secret, test.time/totpPeriod); code != test.code {
+			t.Errorf("at %d: expected %s, got %s", test.time, test.code, code)
+		}
+	}
+}
+
+// waitForStepStart avoids running checks right before the time step changes
+func waitForStepStart() {
+	if time.Now().Unix()%totpPeriod >= totpPeriod-2 {
+		time.Sleep(3 * time.Second)
+	}
+}
+
+func TestCheckTOTP(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	encoded := totpEncoding.EncodeToString(secret)
+
+	waitForStepStart()
+	current := time.Now().Unix() / totpPeriod
+
+	// Codes within the allowed skew are accepted
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if matched := checkTOTP(encoded, totpCode(secret, step), 0); matched != step {
+			t.Errorf("expected code for step %d (current %d) to match, got %d", step, current, matched)
+		}
+	}
+
+	// Codes outside of it aren't
+	for _, step := range []int64{current - totpSkew - 1, current + totpSkew + 1} {
+		if matched := checkTOTP(encoded, totpCode(secret, step), 0); matched != -1 {
+			t.Errorf("expected code for step %d (current %d) to be rejected, matched %d", step, current, matched)
+		}
+	}
+
+	// Codes for steps that were already used aren't accepted again
+	if matched := checkTOTP(encoded, totpCode(secret, current), current); matched != -1 {
+		t.Errorf("expected used code to be rejected, matched %d", matched)
+	}
+
+	if matched := checkTOTP("not base32!", totpCode(secret, current), 0); matched != -1 {
+		t.Errorf("expected invalid secret to be rejected, matched %d", matched)
+	}
+}
+
+// enrollTOTP creates a user with TOTP enabled, returning its secret and recovery codes
+func enrollTOTP(t *testing.T, store *Storage, username string, key string) ([]byte, []string) {
+	t.Helper()
+	ctx := context.Background()
+
+	if err := store.CreateUser(ctx, username, key, ULStreamer); err != nil {
+		t.Fatalf("creating user: %s", err)
+	}
+	encoded, _, err := store.BeginTOTPEnrollment(ctx, username)
+	if err != nil {
+		t.Fatalf("starting enrollment: %s", err)
+	}
+	secret, err := totpEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatalf("decoding secret: %s", err)
+	}
+
+	waitForStepStart()
+	codes, err := store.ConfirmTOTP(ctx, username, totpCode(secret, time.Now().Unix()/totpPeriod))
+	if err != nil {
+		t.Fatalf("confirming enrollment: %s", err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("expected %d recovery codes, got %d", recoveryCodeCount, len(codes))
+	}
+	return secret, codes
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStorage(t)
+	_, codes := enrollTOTP(t, store, "alice", "password")
+
+	if err := store.verifyOTP(ctx, "alice", codes[0], "127.0.0.1"); err != nil {
+		t.Fatalf("expected recovery code to be accepted, got %v", err)
+	}
+	if err := store.verifyOTP(ctx, "alice", codes[0], "127.0.0.1"); err != ErrInvalidOTP {
+		t.Fatalf("expected used recovery code to be rejected, got %v", err)
+	}
+
+	user, _ := store.GetUser("alice")
+	if len(user.RecoveryCodes) != recoveryCodeCount-1 {
+		t.Errorf("expected %d recovery codes left, got %d", recoveryCodeCount-1, len(user.RecoveryCodes))
+	}
+
+	// Other codes still work
+	if err := store.verifyOTP(ctx, "alice", codes[1], "127.0.0.1"); err != nil {
+		t.Errorf("expected another recovery code to be accepted, got %v", err)
+	}
+}
+
+func TestAuthenticateKeepsFailuresUntilOTP(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStorage(t)
+	_, codes := enrollTOTP(t, store, "alice", "password")
+	info := SessionInfo{IP: "127.0.0.1"}
+
+	if _, _, err := store.Authenticate(ctx, "alice", "password", "", jwt.StandardClaims{}, info); err != ErrOTPRequired {
+		t.Fatalf("expected otp to be required, got %v", err)
+	}
+
+	// The right key with a wrong code must still count as a failure
+	for i := 0; i < 2; i++ {
+		if _, _, err := store.Authenticate(ctx, "alice", "password", "000000x", jwt.StandardClaims{}, info); err != ErrInvalidOTP {
+			t.Fatalf("expected invalid otp, got %v", err)
+		}
+	}
+	lockout, err := store.getLockout(ctx, LockoutUser, "alice")
+	if err != nil {
+		t.Fatalf("reading lockout: %s", err)
+	}
+	if lockout.Failures != 2 {
+		t.Fatalf("expected 2 failures, got %d", lockout.Failures)
+	}
+
+	// Failures are only forgotten once the whole login succeeds
+	claims, token, err := store.Authenticate(ctx, "alice", "password", codes[0], jwt.StandardClaims{}, info)
+	if err != nil {
+		t.Fatalf("expected login to succeed, got %v", err)
+	}
+	if claims.User != "alice" || token == "" {
+		t.Errorf("expected a token for alice, got %q (%q)", claims.User, token)
+	}
+	if _, err := store.db.GetKey(ctx, lockoutKey(LockoutUser, "alice")); err != kv.ErrorKeyNotFound {
+		t.Errorf("expected failures to be cleared, got %v", err)
+	}
+}
@@ -0,0 +1,425 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	kv "github.com/strimertul/kilovolt/v8"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrInvalidOAuthState = errors.New("invalid or expired oauth state")
+	ErrInvalidLogin      = errors.New("invalid or expired login")
+	ErrLoginPending      = errors.New("login not completed yet")
+	ErrTwitchNotAllowed  = errors.New("twitch account is not linked or allowed")
+	ErrAllowedNotFound   = errors.New("twitch account not in allowlist")
+	ErrLoginNotBound     = errors.New("login was started from a different browser")
+)
+
+const (
+	oauthStatePrefix      = "stulbe-auth/oauth-states/"
+	twitchLoginPrefix     = "stulbe-auth/twitch-logins/"
+	twitchLinksPrefix     = "stulbe-auth/twitch-links/"
+	twitchAllowlistPrefix = "stulbe-auth/twitch-allowlist/"
+)
+
+// How long users have to complete the Twitch authorization
+const oauthStateLifetime = 10 * time.Minute
+
+type OAuthPurpose string
+
+const (
+	// OAuthLink links a Twitch account to an authenticated user
+	OAuthLink OAuthPurpose = "link"
+	// OAuthLogin logs in with a Twitch account
+	OAuthLogin OAuthPurpose = "login"
+)
+
+// OAuthState is what an OAuth state nonce was issued for
+type OAuthState struct {
+	Purpose OAuthPurpose `json:"purpose"`
+	// User the Twitch account is being linked to (OAuthLink only)
+	User string `json:"user,omitempty"`
+	// Hash of the ID the browser uses to complete the login (OAuthLogin only)
+	LoginKey  string    `json:"login,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// BoundTo returns true if the state was issued for the login with the given
+// ID, which only the browser that started the login has
+func (state OAuthState) BoundTo(loginID string) bool {
+	if state.LoginKey == "" || loginID == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(state.LoginKey), []byte(hashToken(loginID))) == 1
+}
+
+type TwitchLoginStatus string
+
+const (
+	TwitchLoginPending TwitchLoginStatus = "pending"
+	TwitchLoginDone    TwitchLoginStatus = "done"
+	TwitchLoginFailed  TwitchLoginStatus = "failed"
+)
+
+// TwitchLogin tracks a login with Twitch until the client that started it
+// picks up the result
+type TwitchLogin struct {
+	Status    TwitchLoginStatus `json:"status"`
+	User      string            `json:"user,omitempty"`
+	Error     string            `json:"error,omitempty"`
+	ExpiresAt time.Time         `json:"expires_at"`
+}
+
+// TwitchLoginStart is what the client needs to go through a login with Twitch
+type TwitchLoginStart struct {
+	// ID the browser uses to complete the login, it must never be handed to
+	// anyone else
+	ID string
+	// State nonce for the authorization request
+	State     string
+	ExpiresAt time.Time
+}
+
+// TwitchLink maps a Twitch account to the user it's linked to
+type TwitchLink struct {
+	TwitchID  string    `json:"twitch_id"`
+	User      string    `json:"user"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AllowedTwitchUser is a Twitch account that can log in without being linked
+// first, the user is created with Level on the first login. If the user
+// already exists, its owner has to link the account before it can be used.
+type AllowedTwitchUser struct {
+	TwitchID  string    `json:"twitch_id"`
+	User      string    `json:"user"`
+	Level     UserLevel `json:"level"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CreateOAuthState issues a single-use nonce to be used as the state of an
+// authorization request
+func (db *Storage) CreateOAuthState(ctx context.Context, state OAuthState) (string, error) {
+	nonce, err := randomHex(24)
+	if err != nil {
+		return "", err
+	}
+	state.ExpiresAt = time.Now().Add(oauthStateLifetime)
+	return nonce, db.db.PutJSONTTL(ctx, oauthStatePrefix+hashToken(nonce), state, oauthStateLifetime)
+}
+
+// ConsumeOAuthState returns what a state nonce was issued for, nonces can only be used once
+func (db *Storage) ConsumeOAuthState(ctx context.Context, nonce string) (OAuthState, error) {
+	key := oauthStatePrefix + hashToken(nonce)
+
+	var state OAuthState
+	err := db.consumeJSON(ctx, key, &state)
+	if err != nil {
+		if err == kv.ErrorKeyNotFound {
+			return OAuthState{}, ErrInvalidOAuthState
+		}
+		return OAuthState{}, err
+	}
+
+	if state.ExpiresAt.Before(time.Now()) {
+		return OAuthState{}, ErrInvalidOAuthState
+	}
+	return state, nil
+}
+
+// StartTwitchLogin begins a login with Twitch. The login ID must only be kept
+// by the browser that started the login, so that an authorization URL sent to
+// someone else can't complete it.
+func (db *Storage) StartTwitchLogin(ctx context.Context) (TwitchLoginStart, error) {
+	loginID, err := randomHex(32)
+	if err != nil {
+		return TwitchLoginStart{}, err
+	}
+	loginKey := hashToken(loginID)
+
+	nonce, err := db.CreateOAuthState(ctx, OAuthState{
+		Purpose:  OAuthLogin,
+		LoginKey: loginKey,
+	})
+	if err != nil {
+		return TwitchLoginStart{}, err
+	}
+
+	expiresAt := time.Now().Add(oauthStateLifetime)
+	err = db.db.PutJSONTTL(ctx, twitchLoginPrefix+loginKey, TwitchLogin{
+		Status:    TwitchLoginPending,
+		ExpiresAt: expiresAt,
+	}, oauthStateLifetime)
+	if err != nil {
+		return TwitchLoginStart{}, err
+	}
+	return TwitchLoginStart{
+		ID:        loginID,
+		State:     nonce,
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+// FinishTwitchLogin records the outcome of the Twitch authorization for a
+// login, it's called from the OAuth callback with the state's login key
+func (db *Storage) FinishTwitchLogin(ctx context.Context, loginKey string, twitchID string) (string, error) {
+	key := twitchLoginPrefix + loginKey
+
+	var login TwitchLogin
+	err := db.db.GetJSON(ctx, key, &login)
+	if err != nil {
+		if err == kv.ErrorKeyNotFound {
+			return "", ErrInvalidLogin
+		}
+		return "", err
+	}
+
+	user, err := db.resolveTwitchUser(ctx, twitchID)
+	if err != nil {
+		if err != ErrTwitchNotAllowed {
+			return "", err
+		}
+		login.Status = TwitchLoginFailed
+		login.Error = err.Error()
+	} else {
+		login.Status = TwitchLoginDone
+		login.User = user
+	}
+
+	putErr := db.db.PutJSONTTL(ctx, key, login, time.Until(login.ExpiresAt))
+	if putErr != nil {
+		return "", putErr
+	}
+	return user, err
+}
+
+// CompleteTwitchLogin issues a token for a login once the Twitch authorization
+// is done, users with TOTP enabled must also provide a one-time code
+func (db *Storage) CompleteTwitchLogin(ctx context.Context, loginID string, otp string, claims jwt.StandardClaims, info SessionInfo) (UserClaims, string, error) {
+	key := twitchLoginPrefix + hashToken(loginID)
+
+	var login TwitchLogin
+	version, err := db.getVersionedJSON(ctx, key, &login)
+	if err != nil {
+		if err == kv.ErrorKeyNotFound {
+			return UserClaims{}, "", ErrInvalidLogin
+		}
+		return UserClaims{}, "", err
+	}
+
+	if login.ExpiresAt.Before(time.Now()) {
+		err = db.db.RemoveKey(ctx, key)
+		if err != nil {
+			return UserClaims{}, "", err
+		}
+		return UserClaims{}, "", ErrInvalidLogin
+	}
+
+	switch login.Status {
+	case TwitchLoginPending:
+		return UserClaims{}, "", ErrLoginPending
+	case TwitchLoginFailed:
+		err = db.db.RemoveKey(ctx, key)
+		if err != nil {
+			return UserClaims{}, "", err
+		}
+		return UserClaims{}, "", ErrTwitchNotAllowed
+	}
+
+	if err := db.checkLockout(ctx, LockoutIP, info.IP); err != nil {
+		return UserClaims{}, "", err
+	}
+	if err := db.checkLockout(ctx, LockoutUser, login.User); err != nil {
+		return UserClaims{}, "", err
+	}
+
+	user, ok := db.GetUser(login.User)
+	if !ok {
+		return UserClaims{}, "", ErrUserNotFound
+	}
+
+	// Keep the login around on OTP errors so that the client can retry
+	if user.TOTPEnabled() {
+		err = db.verifyOTP(ctx, user.User, otp, info.IP)
+		if err != nil {
+			return UserClaims{}, "", err
+		}
+	}
+
+	// Only one request can complete the login
+	err = db.removeIfUnchanged(ctx, key, version)
+	if err != nil {
+		if err == kv.ErrorKeyNotFound {
+			return UserClaims{}, "", ErrInvalidLogin
+		}
+		return UserClaims{}, "", err
+	}
+	err = db.loginSucceeded(ctx, user.User)
+	if err != nil {
+		return UserClaims{}, "", err
+	}
+	return db.issueToken(ctx, user, claims, info)
+}
+
+// resolveTwitchUser returns the user a Twitch account can log in as. Accounts
+// in the allowlist get a new user if it doesn't exist yet, existing users can
+// only be logged into with a Twitch account they linked themselves.
+func (db *Storage) resolveTwitchUser(ctx context.Context, twitchID string) (string, error) {
+	user, err := db.TwitchUser(ctx, twitchID)
+	if err == nil {
+		return user, nil
+	}
+	if err != ErrTwitchNotAllowed {
+		return "", err
+	}
+
+	var allowed AllowedTwitchUser
+	err = db.db.GetJSON(ctx, twitchAllowlistPrefix+twitchID, &allowed)
+	if err != nil {
+		if err == kv.ErrorKeyNotFound {
+			return "", ErrTwitchNotAllowed
+		}
+		return "", err
+	}
+
+	// Nobody knows this key, the user can only log in with Twitch until they change it
+	key, err := GenerateKey()
+	if err != nil {
+		return "", err
+	}
+	err = db.CreateUser(ctx, allowed.User, key, allowed.Level)
+	if err != nil {
+		if err == ErrUserExists {
+			db.logger.Warn("refusing twitch login for existing user not linked to the account", zap.String("user", allowed.User), zap.String("twitch-id", twitchID))
+			return "", ErrTwitchNotAllowed
+		}
+		return "", err
+	}
+	db.logger.Info("created user from twitch allowlist", zap.String("user", allowed.User), zap.String("twitch-id", twitchID))
+
+	return allowed.User, db.LinkTwitch(ctx, allowed.User, twitchID)
+}
+
+// TwitchUser returns the user a Twitch account is linked to
+func (db *Storage) TwitchUser(ctx context.Context, twitchID string) (string, error) {
+	var link TwitchLink
+	err := db.db.GetJSON(ctx, twitchLinksPrefix+twitchID, &link)
+	if err != nil {
+		if err == kv.ErrorKeyNotFound {
+			return "", ErrTwitchNotAllowed
+		}
+		return "", err
+	}
+	if _, ok := db.GetUser(link.User); !ok {
+		return "", ErrTwitchNotAllowed
+	}
+	return link.User, nil
+}
+
+// LinkTwitch links a Twitch account to a user, replacing any other account
+// linked to the same user
+func (db *Storage) LinkTwitch(ctx context.Context, user string, twitchID string) error {
+	err := db.UnlinkTwitch(ctx, user)
+	if err != nil {
+		return err
+	}
+	return db.db.PutJSON(ctx, twitchLinksPrefix+twitchID, TwitchLink{
+		TwitchID:  twitchID,
+		User:      user,
+		CreatedAt: time.Now(),
+	})
+}
+
+// UnlinkTwitch removes the Twitch account linked to a user, if any
+func (db *Storage) UnlinkTwitch(ctx context.Context, user string) error {
+	data, err := db.db.GetAll(ctx, twitchLinksPrefix)
+	if err != nil {
+		return err
+	}
+	for key, value := range data {
+		if value == "" {
+			continue
+		}
+		var link TwitchLink
+		err := json.Unmarshal([]byte(value), &link)
+		if err != nil {
+			db.logger.Warn("skipping invalid twitch link record", zap.String("key", key), zap.Error(err))
+			continue
+		}
+		if link.User != user {
+			continue
+		}
+		err = db.db.RemoveKey(ctx, key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AllowTwitchUser adds (or replaces) a Twitch account in the allowlist
+func (db *Storage) AllowTwitchUser(ctx context.Context, twitchID string, user string, level UserLevel, createdBy string) (AllowedTwitchUser, error) {
+	if !ValidUsername(user) {
+		return AllowedTwitchUser{}, ErrInvalidUsername
+	}
+	if !level.Valid() {
+		return AllowedTwitchUser{}, ErrInvalidLevel
+	}
+
+	allowed := AllowedTwitchUser{
+		TwitchID:  twitchID,
+		User:      user,
+		Level:     level,
+		CreatedBy: createdBy,
+		CreatedAt: time.Now(),
+	}
+	return allowed, db.db.PutJSON(ctx, twitchAllowlistPrefix+twitchID, allowed)
+}
+
+// ListAllowedTwitchUsers returns all Twitch accounts in the allowlist
+func (db *Storage) ListAllowedTwitchUsers(ctx context.Context) ([]AllowedTwitchUser, error) {
+	data, err := db.db.GetAll(ctx, twitchAllowlistPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	allowlist := []AllowedTwitchUser{}
+	for key, value := range data {
+		if value == "" {
+			continue
+		}
+		var allowed AllowedTwitchUser
+		err := json.Unmarshal([]byte(value), &allowed)
+		if err != nil {
+			db.logger.Warn("skipping invalid twitch allowlist record", zap.String("key", key), zap.Error(err))
+			continue
+		}
+		allowlist = append(allowlist, allowed)
+	}
+
+	sort.Slice(allowlist, func(i, j int) bool {
+		return allowlist[i].CreatedAt.Before(allowlist[j].CreatedAt)
+	})
+	return allowlist, nil
+}
+
+// RemoveAllowedTwitchUser removes a Twitch account from the allowlist, users
+// created from it (and their links) are kept
+func (db *Storage) RemoveAllowedTwitchUser(ctx context.Context, twitchID string) error {
+	var allowed AllowedTwitchUser
+	err := db.db.GetJSON(ctx, twitchAllowlistPrefix+twitchID, &allowed)
+	if err != nil {
+		if err == kv.ErrorKeyNotFound {
+			return ErrAllowedNotFound
+		}
+		return err
+	}
+	return db.db.RemoveKey(ctx, twitchAllowlistPrefix+twitchID)
+}
@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"context"
+	"testing"
+)
+
+func TestResolveTwitchUser(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStorage(t)
+
+	if _, err := store.resolveTwitchUser(ctx, "1000"); err != ErrTwitchNotAllowed {
+		t.Fatalf("expected unknown account to be refused, got %v", err)
+	}
+
+	// Allowlisted accounts get a new user with the allowed level
+	if _, err := store.AllowTwitchUser(ctx, "1000", "newbie", ULModerator, "admin"); err != nil {
+		t.Fatalf("allowing account: %s", err)
+	}
+	user, err := store.resolveTwitchUser(ctx, "1000")
+	if err != nil || user != "newbie" {
+		t.Fatalf("expected newbie, got %q (%v)", user, err)
+	}
+	created, ok := store.GetUser("newbie")
+	if !ok || created.Level != ULModerator {
+		t.Fatalf("expected newbie to be created as moderator, got %+v", created)
+	}
+	// Later logins go through the link
+	if user, err := store.resolveTwitchUser(ctx, "1000"); err != nil || user != "newbie" {
+		t.Errorf("expected newbie again, got %q (%v)", user, err)
+	}
+
+	// Existing users can't be taken over through the allowlist
+	if err := store.CreateUser(ctx, "boss", "password", ULAdmin); err != nil {
+		t.Fatalf("creating user: %s", err)
+	}
+	if err := store.LinkTwitch(ctx, "boss", "2000"); err != nil {
+		t.Fatalf("linking account: %s", err)
+	}
+	if _, err := store.AllowTwitchUser(ctx, "3000", "boss", ULAdmin, "admin"); err != nil {
+		t.Fatalf("allowing account: %s", err)
+	}
+	if _, err := store.resolveTwitchUser(ctx, "3000"); err != ErrTwitchNotAllowed {
+		t.Fatalf("expected existing user to be refused, got %v", err)
+	}
+	if linked, err := store.TwitchUser(ctx, "2000"); err != nil || linked != "boss" {
+		t.Errorf("expected the existing link to be kept, got %q (%v)", linked, err)
+	}
+}
@@ -1,10 +1,16 @@
 package auth
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"regexp"
+	"sort"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
+	"go.uber.org/zap"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -13,6 +19,10 @@ var (
 	ErrInvalidKey       = errors.New("invalid auth")
 	ErrTokenParseFailed = errors.New("couldnt parse jwt")
 	ErrTokenExpired     = errors.New("token expired")
+	ErrUserExists       = errors.New("user already exists")
+	ErrInvalidLevel     = errors.New("invalid user level")
+	ErrSessionRevoked   = errors.New("session revoked")
+	ErrInvalidUsername  = errors.New("invalid username")
 )
 
 type UserList map[string]User
@@ -23,86 +33,408 @@ type User struct {
 	User    string    `json:"user"`
 	AuthKey []byte    `json:"authkey"`
 	Level   UserLevel `json:"level"`
+
+	// TOTP second factor, enabled when TOTPSecret is set
+	TOTPSecret    string   `json:"totp_secret,omitempty"`
+	TOTPPending   string   `json:"totp_pending,omitempty"`
+	TOTPLastStep  int64    `json:"totp_last_step,omitempty"`
+	RecoveryCodes [][]byte `json:"recovery_codes,omitempty"`
+}
+
+// TOTPEnabled returns true if the user must provide a one-time code to log in
+func (u User) TOTPEnabled() bool {
+	return u.TOTPSecret != ""
 }
 
 type UserClaims struct {
-	User  string    `json:"user"`
-	Level UserLevel `json:"level"`
+	User   string    `json:"user"`
+	Level  UserLevel `json:"level"`
+	Scopes []string  `json:"scopes,omitempty"`
 	jwt.StandardClaims
 }
 
 type UserLevel string
 
 const (
-	ULAdmin    UserLevel = "admin"
-	ULStreamer UserLevel = "streamer"
+	ULAdmin     UserLevel = "admin"
+	ULStreamer  UserLevel = "streamer"
+	ULModerator UserLevel = "moderator"
+	ULBot       UserLevel = "bot"
 )
 
-func (db *Storage) saveUsers() error {
-	return db.db.PutJSON(usersKey, db.users)
+// Valid returns true if the level is one of the known user levels
+func (l UserLevel) Valid() bool {
+	switch l {
+	case ULAdmin, ULStreamer, ULModerator, ULBot:
+		return true
+	}
+	return false
+}
+
+var usernameRegex = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,64}$`)
+
+// ValidUsername returns true if the name can be used for a new user, names
+// are used in KV keys so they can't contain separators
+func ValidUsername(username string) bool {
+	return usernameRegex.MatchString(username)
+}
+
+// GenerateKey creates a random auth key, for when one isn't provided
+func GenerateKey() (string, error) {
+	return randomHex(24)
+}
+
+func randomHex(size int) (string, error) {
+	byt := make([]byte, size)
+	_, err := rand.Read(byt)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(byt), nil
+}
+
+// saveUsers writes the user list to the DB, must be called with usersMu held
+func (db *Storage) saveUsers(ctx context.Context) error {
+	byt, err := json.Marshal(db.users)
+	if err != nil {
+		return err
+	}
+
+	// Remember our own write so its notification doesn't get applied twice
+	hash := hashToken(string(byt))
+	db.pendingWrites[hash]++
+	err = db.db.PutKey(ctx, usersKey, string(byt))
+	if err != nil {
+		db.forgetWrite(hash)
+	}
+	return err
+}
+
+func (db *Storage) forgetWrite(hash string) {
+	if db.pendingWrites[hash] <= 1 {
+		delete(db.pendingWrites, hash)
+	} else {
+		db.pendingWrites[hash]--
+	}
+}
+
+// onUsersChanged queues user list changes to be applied by watchUsers, this is
+// called from the DB client loop so it must never block on anything that
+// could be waiting for a DB response
+func (db *Storage) onUsersChanged(key string, value string) {
+	if key != usersKey {
+		return
+	}
+
+	db.updatesMu.Lock()
+	db.updates = append(db.updates, value)
+	db.updatesMu.Unlock()
+
+	select {
+	case db.updateSignal <- struct{}{}:
+	default:
+	}
+}
+
+// watchUsers reloads the user list when it's changed in the DB
+func (db *Storage) watchUsers() {
+	for range db.updateSignal {
+		db.updatesMu.Lock()
+		updates := db.updates
+		db.updates = nil
+		db.updatesMu.Unlock()
+
+		for _, value := range updates {
+			db.applyUsers(value)
+		}
+	}
+}
+
+func (db *Storage) applyUsers(value string) {
+	db.usersMu.Lock()
+	defer db.usersMu.Unlock()
+
+	// Skip notifications for our own writes, the list is already up to date
+	hash := hashToken(value)
+	if db.pendingWrites[hash] > 0 {
+		db.forgetWrite(hash)
+		return
+	}
+
+	// Someone else changed the list, our pending writes are now applied like
+	// any other change so that we always end up with the last list written
+	for pending := range db.pendingWrites {
+		delete(db.pendingWrites, pending)
+	}
+
+	users := make(UserList)
+	if value != "" {
+		err := json.Unmarshal([]byte(value), &users)
+		if err != nil {
+			db.logger.Error("user list changed but it couldn't be parsed, ignoring", zap.Error(err))
+			return
+		}
+	} else {
+		db.logger.Warn("user list was removed from the DB")
+	}
+	db.users = users
+	db.logger.Info("reloaded user list", zap.Int("users", len(users)))
 }
 
-func (db *Storage) AddUser(user string, key string, level UserLevel) error {
+// AddUser creates a user, replacing any existing user with the same name
+func (db *Storage) AddUser(ctx context.Context, user string, key string, level UserLevel) error {
 	// Hash password
 	password, err := bcrypt.GenerateFromPassword([]byte(key), bcrypt.DefaultCost)
 	if err != nil {
 		return err
 	}
 
+	db.usersMu.Lock()
+	defer db.usersMu.Unlock()
+
 	db.users[user] = User{
 		User:    user,
 		AuthKey: password,
 		Level:   level,
 	}
-	return db.saveUsers()
+	return db.saveUsers(ctx)
 }
 
-func (db *Storage) DeleteUser(user string) error {
-	delete(db.users, user)
-	return db.saveUsers()
+// CreateUser creates a new user, failing if one with the same name exists
+func (db *Storage) CreateUser(ctx context.Context, user string, key string, level UserLevel) error {
+	if !ValidUsername(user) {
+		return ErrInvalidUsername
+	}
+	if !level.Valid() {
+		return ErrInvalidLevel
+	}
+
+	// Hash password
+	password, err := bcrypt.GenerateFromPassword([]byte(key), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	db.usersMu.Lock()
+	defer db.usersMu.Unlock()
+
+	if _, ok := db.users[user]; ok {
+		return ErrUserExists
+	}
+	db.users[user] = User{
+		User:    user,
+		AuthKey: password,
+		Level:   level,
+	}
+	return db.saveUsers(ctx)
+}
+
+func (db *Storage) DeleteUser(ctx context.Context, user string) error {
+	err := func() error {
+		db.usersMu.Lock()
+		defer db.usersMu.Unlock()
+
+		if _, ok := db.users[user]; !ok {
+			return ErrUserNotFound
+		}
+		delete(db.users, user)
+		return db.saveUsers(ctx)
+	}()
+	if err != nil {
+		return err
+	}
+	_, err = db.RevokeAllSessions(ctx, user)
+	if err != nil {
+		return err
+	}
+	err = db.removeUserGrants(ctx, user)
+	if err != nil {
+		return err
+	}
+	return db.UnlinkTwitch(ctx, user)
+}
+
+// updateUser applies fn to a user and saves the result
+func (db *Storage) updateUser(ctx context.Context, username string, fn func(user *User) error) error {
+	db.usersMu.Lock()
+	defer db.usersMu.Unlock()
+
+	user, ok := db.users[username]
+	if !ok {
+		return ErrUserNotFound
+	}
+	err := fn(&user)
+	if err != nil {
+		return err
+	}
+	db.users[username] = user
+	return db.saveUsers(ctx)
+}
+
+// SetUserLevel changes the level of an existing user
+func (db *Storage) SetUserLevel(ctx context.Context, username string, level UserLevel) error {
+	if !level.Valid() {
+		return ErrInvalidLevel
+	}
+	return db.updateUser(ctx, username, func(user *User) error {
+		user.Level = level
+		return nil
+	})
+}
+
+// SetUserKey replaces the auth key of an existing user and revokes all
+// of their sessions
+func (db *Storage) SetUserKey(ctx context.Context, username string, key string) error {
+	if key == "" {
+		return ErrInvalidKey
+	}
+	password, err := bcrypt.GenerateFromPassword([]byte(key), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	err = db.updateUser(ctx, username, func(user *User) error {
+		user.AuthKey = password
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	_, err = db.RevokeAllSessions(ctx, username)
+	return err
+}
+
+// ListUsers returns all registered users, sorted by name
+func (db *Storage) ListUsers() []User {
+	db.usersMu.RLock()
+	defer db.usersMu.RUnlock()
+
+	users := make([]User, 0, len(db.users))
+	for _, user := range db.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].User < users[j].User
+	})
+	return users
 }
 
 func (db *Storage) GetUser(username string) (User, bool) {
+	db.usersMu.RLock()
+	defer db.usersMu.RUnlock()
+
 	user, ok := db.users[username]
 	return user, ok
 }
 
 func (db *Storage) CountUsers() int {
+	db.usersMu.RLock()
+	defer db.usersMu.RUnlock()
+
 	return len(db.users)
 }
 
-func (db *Storage) Authenticate(username string, key string, claims jwt.StandardClaims) (UserClaims, string, error) {
+// CheckKey verifies a user's auth key, failed attempts are counted per user
+// and per address and will result in a LockoutError once too many are made.
+// Failures aren't cleared on success since the login might still need a
+// one-time code, see loginSucceeded.
+func (db *Storage) CheckKey(ctx context.Context, username string, key string, ip string) (User, error) {
+	// Check for lockouts before doing any expensive work
+	if err := db.checkLockout(ctx, LockoutIP, ip); err != nil {
+		return User{}, err
+	}
+	if err := db.checkLockout(ctx, LockoutUser, username); err != nil {
+		return User{}, err
+	}
+
 	user, ok := db.GetUser(username)
 	if !ok {
-		return UserClaims{}, "", ErrUserNotFound
+		// Only count failures by address, to avoid storing arbitrary usernames
+		if err := db.recordFailure(ctx, LockoutIP, ip); err != nil {
+			return User{}, err
+		}
+		return User{}, ErrUserNotFound
 	}
 
 	err := bcrypt.CompareHashAndPassword(user.AuthKey, []byte(key))
 	if err != nil {
 		if err == bcrypt.ErrMismatchedHashAndPassword {
-			return UserClaims{}, "", ErrInvalidKey
+			if err := db.recordFailure(ctx, LockoutIP, ip); err != nil {
+				return User{}, err
+			}
+			if err := db.recordFailure(ctx, LockoutUser, username); err != nil {
+				return User{}, err
+			}
+			return User{}, ErrInvalidKey
 		}
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+// Authenticate checks a user's credentials (and one-time code, if they have
+// TOTP enabled) and issues a token for a new session. If the claims don't
+// specify an expiration, the lifetime configured for the user's level is used.
+func (db *Storage) Authenticate(ctx context.Context, username string, key string, otp string, claims jwt.StandardClaims, info SessionInfo) (UserClaims, string, error) {
+	user, err := db.CheckKey(ctx, username, key, info.IP)
+	if err != nil {
 		return UserClaims{}, "", err
 	}
 
+	if user.TOTPEnabled() {
+		err = db.verifyOTP(ctx, user.User, otp, info.IP)
+		if err != nil {
+			return UserClaims{}, "", err
+		}
+	}
+
+	err = db.loginSucceeded(ctx, user.User)
+	if err != nil {
+		return UserClaims{}, "", err
+	}
+	return db.issueToken(ctx, user, claims, info)
+}
+
+// issueToken creates a session for a user that has already been authenticated
+// and returns a token for it
+func (db *Storage) issueToken(ctx context.Context, user User, claims jwt.StandardClaims, info SessionInfo) (UserClaims, string, error) {
+	if claims.ExpiresAt == 0 {
+		claims.ExpiresAt = time.Now().Add(db.TokenLifetime(user.Level)).Unix()
+	}
+
+	// Register session, its ID becomes the token ID
+	session, err := db.createSession(ctx, user.User, info, time.Unix(claims.ExpiresAt, 0))
+	if err != nil {
+		return UserClaims{}, "", err
+	}
+	claims.Id = session.ID
+	claims.IssuedAt = session.CreatedAt.Unix()
+
 	userClaims := UserClaims{
 		User:           user.User,
 		Level:          user.Level,
 		StandardClaims: claims,
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, userClaims)
-
-	signedToken, err := token.SignedString(db.secretKey)
+	signedToken, err := db.sign(userClaims)
 
 	return userClaims, signedToken, err
 }
 
-func (db *Storage) Verify(token string) (*UserClaims, error) {
+func (db *Storage) Verify(ctx context.Context, token string) (*UserClaims, error) {
 	tk, err := jwt.ParseWithClaims(
 		token,
 		&UserClaims{},
 		func(token *jwt.Token) (interface{}, error) {
-			return db.secretKey, nil
+			kid, _ := token.Header["kid"].(string)
+			key, err := db.verificationKey(kid)
+			if err != nil {
+				return nil, err
+			}
+			// Only accept the algorithm the key was made for
+			if token.Method.Alg() != key.Alg() {
+				return nil, ErrTokenParseFailed
+			}
+			return key.verificationKey(), nil
 		},
 	)
 
@@ -119,5 +451,24 @@ func (db *Storage) Verify(token string) (*UserClaims, error) {
 		return nil, ErrTokenExpired
 	}
 
+	// Check that the session hasn't been revoked
+	if claims.Id == "" {
+		return nil, ErrSessionRevoked
+	}
+	_, err = db.GetSession(ctx, claims.User, claims.Id)
+	if err != nil {
+		if err == ErrSessionNotFound {
+			return nil, ErrSessionRevoked
+		}
+		return nil, err
+	}
+
+	// Permissions follow the current level of the user, not the one at login
+	user, ok := db.GetUser(claims.User)
+	if !ok {
+		return nil, ErrSessionRevoked
+	}
+	claims.Level = user.Level
+
 	return claims, nil
 }
@@ -0,0 +1,202 @@
+package backup
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"go.uber.org/zap"
+)
+
+// Snapshot file names, the timestamp makes them sort by creation time
+const (
+	snapshotPrefix = "stulbe-"
+	snapshotSuffix = ".bak"
+	snapshotTime   = "20060102-150405.000"
+)
+
+// How many writes Load keeps in flight while restoring
+const maxPendingWrites = 256
+
+var (
+	ErrDatabaseNotEmpty = errors.New("database already contains data")
+)
+
+// Backup writes every key changed after version since to w (0 for a full
+// backup), returning the version to use for the next incremental backup.
+// It's safe to call while the database is in use, the backup is made from
+// a single read transaction.
+func Backup(db *badger.DB, w io.Writer, since uint64) (uint64, error) {
+	return db.Backup(w, since)
+}
+
+// Restore loads a backup into the database. Incremental backups must be
+// restored in order on top of the full backup they were made from, unless
+// force is set restoring into a database that has data is refused.
+// Nothing else must write to the database while restoring.
+func Restore(db *badger.DB, r io.Reader, force bool) error {
+	if !force {
+		empty, err := isEmpty(db)
+		if err != nil {
+			return err
+		}
+		if !empty {
+			return ErrDatabaseNotEmpty
+		}
+	}
+	return db.Load(r, maxPendingWrites)
+}
+
+func isEmpty(db *badger.DB) (bool, error) {
+	empty := true
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{})
+		defer it.Close()
+		it.Rewind()
+		empty = !it.Valid()
+		return nil
+	})
+	return empty, err
+}
+
+// Snapshot is a full backup saved by Manager
+type Snapshot struct {
+	Name      string
+	Size      int64
+	CreatedAt time.Time
+	// Version to pass as since to make an incremental backup on top of this one
+	Version uint64
+}
+
+// Manager saves full backups of a running database to a directory,
+// keeping only the most recent ones
+type Manager struct {
+	db     *badger.DB
+	dir    string
+	keep   int
+	logger *zap.Logger
+
+	mu sync.Mutex
+}
+
+// NewManager creates a snapshot manager saving to dir, if keep is more than
+// zero older snapshots are removed once there are more than keep
+func NewManager(db *badger.DB, dir string, keep int, logger *zap.Logger) (*Manager, error) {
+	if logger == nil {
+		logger, _ = zap.NewProduction()
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	return &Manager{
+		db:     db,
+		dir:    dir,
+		keep:   keep,
+		logger: logger,
+	}, nil
+}
+
+// Create saves a new snapshot and removes the ones past the retention limit
+func (m *Manager) Create() (Snapshot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().UTC()
+	name := snapshotPrefix + now.Format(snapshotTime) + snapshotSuffix
+	path := filepath.Join(m.dir, name)
+
+	// Write to a temporary file first so that partial snapshots are never listed
+	file, err := os.CreateTemp(m.dir, name+".*.tmp")
+	if err != nil {
+		return Snapshot{}, err
+	}
+	version, err := Backup(m.db, file, 0)
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return Snapshot{}, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	m.logger.Info("created snapshot", zap.String("name", name), zap.Int64("size", info.Size()))
+
+	if err := m.prune(); err != nil {
+		// The snapshot itself is fine, old ones will be cleaned up next time
+		m.logger.Warn("could not remove old snapshots", zap.Error(err))
+	}
+
+	return Snapshot{
+		Name:      name,
+		Size:      info.Size(),
+		CreatedAt: now,
+		Version:   version,
+	}, nil
+}
+
+// List returns the saved snapshots, most recent first
+func (m *Manager) List() ([]Snapshot, error) {
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []Snapshot
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, snapshotPrefix) || !strings.HasSuffix(name, snapshotSuffix) {
+			continue
+		}
+		createdAt, err := time.Parse(snapshotTime, strings.TrimSuffix(strings.TrimPrefix(name, snapshotPrefix), snapshotSuffix))
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, Snapshot{
+			Name:      name,
+			Size:      info.Size(),
+			CreatedAt: createdAt,
+		})
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].CreatedAt.After(snapshots[j].CreatedAt)
+	})
+	return snapshots, nil
+}
+
+func (m *Manager) prune() error {
+	if m.keep <= 0 {
+		return nil
+	}
+	snapshots, err := m.List()
+	if err != nil {
+		return err
+	}
+	for i := m.keep; i < len(snapshots); i++ {
+		if err := os.Remove(filepath.Join(m.dir, snapshots[i].Name)); err != nil {
+			return err
+		}
+		m.logger.Info("removed old snapshot", zap.String("name", snapshots[i].Name))
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package backup
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"go.uber.org/zap"
+)
+
+func openTestDB(t *testing.T) *badger.DB {
+	t.Helper()
+	db, err := badger.Open(badger.DefaultOptions(filepath.Join(t.TempDir(), "badger")).WithLogger(nil))
+	if err != nil {
+		t.Fatalf("opening database: %s", err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	return db
+}
+
+func setKeys(t *testing.T, db *badger.DB, data map[string]string) {
+	t.Helper()
+	err := db.Update(func(txn *badger.Txn) error {
+		for key, value := range data {
+			if err := txn.Set([]byte(key), []byte(value)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("writing keys: %s", err)
+	}
+}
+
+func readKeys(t *testing.T, db *badger.DB) map[string]string {
+	t.Helper()
+	out := make(map[string]string)
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			value, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			out[string(it.Item().Key())] = string(value)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("reading keys: %s", err)
+	}
+	return out
+}
+
+func TestBackupRestore(t *testing.T) {
+	source := openTestDB(t)
+	data := map[string]string{
+		"stulbe-auth/users": `{"admin":{}}`,
+		"@userdata/alice/a": "1",
+		"@userdata/alice/b": "2",
+	}
+	setKeys(t, source, data)
+
+	var full bytes.Buffer
+	version, err := Backup(source, &full, 0)
+	if err != nil {
+		t.Fatalf("making backup: %s", err)
+	}
+
+	// Incremental backups only have what changed since the full one
+	setKeys(t, source, map[string]string{"@userdata/alice/c": "3"})
+	var incremental bytes.Buffer
+	_, err = Backup(source, &incremental, version)
+	if err != nil {
+		t.Fatalf("making incremental backup: %s", err)
+	}
+
+	target := openTestDB(t)
+	if err := Restore(target, bytes.NewReader(full.Bytes()), false); err != nil {
+		t.Fatalf("restoring backup: %s", err)
+	}
+	if restored := readKeys(t, target); !reflect.DeepEqual(restored, data) {
+		t.Errorf("expected %v after restoring, got %v", data, restored)
+	}
+
+	// Restoring on top of data must be forced
+	if err := Restore(target, bytes.NewReader(incremental.Bytes()), false); err != ErrDatabaseNotEmpty {
+		t.Fatalf("expected database not empty, got %v", err)
+	}
+	if err := Restore(target, bytes.NewReader(incremental.Bytes()), true); err != nil {
+		t.Fatalf("restoring incremental backup: %s", err)
+	}
+	if restored, expected := readKeys(t, target), readKeys(t, source); !reflect.DeepEqual(restored, expected) {
+		t.Errorf("expected %v after restoring, got %v", expected, restored)
+	}
+}
+
+func TestManager(t *testing.T) {
+	db := openTestDB(t)
+	setKeys(t, db, map[string]string{"key": "value"})
+
+	dir := filepath.Join(t.TempDir(), "backups")
+	manager, err := NewManager(db, dir, 2, zap.NewNop())
+	if err != nil {
+		t.Fatalf("creating manager: %s", err)
+	}
+
+	var created []Snapshot
+	for i := 0; i < 3; i++ {
+		snapshot, err := manager.Create()
+		if err != nil {
+			t.Fatalf("creating snapshot: %s", err)
+		}
+		created = append(created, snapshot)
+		// Snapshot names have millisecond precision
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Only the most recent ones are kept, newest first
+	snapshots, err := manager.List()
+	if err != nil {
+		t.Fatalf("listing snapshots: %s", err)
+	}
+	if len(snapshots) != 2 {
+		t.Fatalf("expected 2 snapshots, got %d", len(snapshots))
+	}
+	if snapshots[0].Name != created[2].Name || snapshots[1].Name != created[1].Name {
+		t.Errorf("expected the last two snapshots, got %s and %s", snapshots[0].Name, snapshots[1].Name)
+	}
+
+	// Snapshots are full backups
+	file, err := os.Open(filepath.Join(dir, snapshots[0].Name))
+	if err != nil {
+		t.Fatalf("opening snapshot: %s", err)
+	}
+	defer file.Close()
+	target := openTestDB(t)
+	if err := Restore(target, file, false); err != nil {
+		t.Fatalf("restoring snapshot: %s", err)
+	}
+	if restored := readKeys(t, target); restored["key"] != "value" {
+		t.Errorf("expected snapshot to contain key, got %v", restored)
+	}
+}
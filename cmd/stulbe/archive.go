@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"go.uber.org/zap"
+
+	"github.com/strimertul/stulbe"
+	"github.com/strimertul/stulbe/archive"
+	"github.com/strimertul/stulbe/storage"
+)
+
+// runExport implements "stulbe export", which writes a user's namespace to an archive
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	dbdir := flags.String("dbfile", "data", "Filename for database")
+	storageKind := flags.String("storage", string(storage.KindBadger), storageUsage)
+	debug := flags.Bool("debug", false, "Enable debug logging")
+	user := flags.String("user", "", "User whose namespace to export")
+	format := flags.String("format", string(archive.FormatJSON), "Archive format (json or ndjson)")
+	output := flags.String("out", "", "File to write the archive to, defaults to stdout")
+	_ = flags.Parse(args)
+
+	initLogger(*debug)
+	if *user == "" {
+		return fmt.Errorf("-user is required")
+	}
+	if !archive.ValidFormat(archive.Format(*format)) {
+		return fmt.Errorf("invalid -format: %w", archive.ErrUnknownFormat)
+	}
+
+	store, _, db := openDatabase(storage.Kind(*storageKind), *dbdir)
+	defer store.Close()
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return fmt.Errorf("could not create output file: %w", err)
+		}
+		defer file.Close()
+		out = file
+	}
+
+	count, err := archive.Export(context.Background(), db, out, archive.Format(*format), *user, stulbe.UserNamespace(*user), nil)
+	if err != nil {
+		return fmt.Errorf("could not export namespace: %w", err)
+	}
+
+	log.Info("Exported namespace", zap.String("user", *user), zap.Int("keys", count))
+	return nil
+}
+
+// runImport implements "stulbe import", which writes an archive to a user's namespace
+func runImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	dbdir := flags.String("dbfile", "data", "Filename for database")
+	storageKind := flags.String("storage", string(storage.KindBadger), storageUsage)
+	debug := flags.Bool("debug", false, "Enable debug logging")
+	user := flags.String("user", "", "User whose namespace to import into")
+	input := flags.String("in", "", "Archive to import, defaults to stdin")
+	mode := flags.String("mode", string(archive.ModeMerge), "Import mode, merge keeps keys that aren't in the archive, replace removes them")
+	dryRun := flags.Bool("dry-run", false, "Only report what would change")
+	_ = flags.Parse(args)
+
+	initLogger(*debug)
+	if *user == "" {
+		return fmt.Errorf("-user is required")
+	}
+
+	var in io.Reader = os.Stdin
+	if *input != "" {
+		file, err := os.Open(*input)
+		if err != nil {
+			return fmt.Errorf("could not open archive: %w", err)
+		}
+		defer file.Close()
+		in = file
+	}
+	data, err := archive.Read(in)
+	if err != nil {
+		return fmt.Errorf("could not read archive: %w", err)
+	}
+
+	store, _, db := openDatabase(storage.Kind(*storageKind), *dbdir)
+	defer store.Close()
+
+	result, err := archive.Import(context.Background(), db, stulbe.UserNamespace(*user), data, archive.ImportOptions{
+		Mode:   archive.Mode(*mode),
+		DryRun: *dryRun,
+	})
+	if err != nil {
+		return fmt.Errorf("could not import archive: %w", err)
+	}
+
+	log.Info("Imported archive",
+		zap.String("user", *user),
+		zap.String("from", data.Namespace),
+		zap.Bool("dry-run", *dryRun),
+		zap.Int("added", result.Added),
+		zap.Int("updated", result.Updated),
+		zap.Int("unchanged", result.Unchanged),
+		zap.Int("removed", result.Removed))
+	return nil
+}
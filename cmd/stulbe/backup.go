@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"go.uber.org/zap"
+
+	"github.com/strimertul/stulbe/backup"
+	"github.com/strimertul/stulbe/storage"
+)
+
+// runBackup implements "stulbe backup", which writes a full or incremental backup of the database.
+// Errors are returned instead of exiting so that the database is closed first.
+func runBackup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	dbdir := flags.String("dbfile", "data", "Filename for database (badger storage only)")
+	debug := flags.Bool("debug", false, "Enable debug logging")
+	output := flags.String("out", "", "File to write the backup to, defaults to stdout")
+	since := flags.Uint64("since", 0, "Only back up changes after this version (printed by the previous backup) for incremental backups")
+	_ = flags.Parse(args)
+
+	initLogger(*debug)
+
+	store, err := storage.OpenBadger(*dbdir)
+	if err != nil {
+		return fmt.Errorf("could not open DB: %w", err)
+	}
+	defer store.Close()
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return fmt.Errorf("could not create output file: %w", err)
+		}
+		defer file.Close()
+		out = file
+	}
+
+	version, err := backup.Backup(store.DB, out, *since)
+	if err != nil {
+		return fmt.Errorf("could not back up database: %w", err)
+	}
+
+	log.Info("Backed up database", zap.Uint64("since", *since), zap.Uint64("version", version))
+	return nil
+}
+
+// runRestore implements "stulbe restore", which loads a backup into the database
+func runRestore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	dbdir := flags.String("dbfile", "data", "Filename for database (badger storage only)")
+	debug := flags.Bool("debug", false, "Enable debug logging")
+	input := flags.String("in", "", "Backup to restore, defaults to stdin")
+	force := flags.Bool("force", false, "Restore into a database that already has data (eg. when applying incremental backups)")
+	_ = flags.Parse(args)
+
+	initLogger(*debug)
+
+	var in io.Reader = os.Stdin
+	if *input != "" {
+		file, err := os.Open(*input)
+		if err != nil {
+			return fmt.Errorf("could not open backup: %w", err)
+		}
+		defer file.Close()
+		in = file
+	}
+
+	store, err := storage.OpenBadger(*dbdir)
+	if err != nil {
+		return fmt.Errorf("could not open DB: %w", err)
+	}
+	defer store.Close()
+
+	err = backup.Restore(store.DB, in, *force)
+	if err != nil {
+		return fmt.Errorf("could not restore backup: %w", err)
+	}
+
+	log.Info("Restored backup", zap.String("dbfile", *dbdir))
+	return nil
+}
@@ -1,64 +1,105 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
 	"strings"
 	"time"
 
-	"github.com/dgraph-io/badger/v3"
 	"github.com/nicklaw5/helix/v2"
 	kv "github.com/strimertul/kilovolt/v8"
-	badger_driver "github.com/strimertul/kv-badgerdb"
 	"go.uber.org/zap"
 
 	"github.com/strimertul/stulbe"
 	"github.com/strimertul/stulbe/auth"
+	"github.com/strimertul/stulbe/backup"
 	"github.com/strimertul/stulbe/database"
+	"github.com/strimertul/stulbe/migrations"
+	"github.com/strimertul/stulbe/storage"
 )
 
 var log *zap.Logger
 
 func main() {
+	// Offline maintenance commands, these need exclusive access to the database
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "export":
+			failOnError(runExport(os.Args[2:]), "Export failed")
+			return
+		case "import":
+			failOnError(runImport(os.Args[2:]), "Import failed")
+			return
+		case "backup":
+			failOnError(runBackup(os.Args[2:]), "Backup failed")
+			return
+		case "restore":
+			failOnError(runRestore(os.Args[2:]), "Restore failed")
+			return
+		case "migrate-storage":
+			failOnError(runMigrateStorage(os.Args[2:]), "Storage migration failed")
+			return
+		}
+	}
+
 	bind := flag.String("bind", ":9999", "Bind addr in format address:port")
 	dbdir := flag.String("dbfile", "data", "Filename for database")
+	storageKind := flag.String("storage", string(storage.KindBadger), storageUsage)
 	debug := flag.Bool("debug", false, "Enable debug logging")
 	bootstrap := flag.String("bootstrap", "", "Create admin user with given credentials (user:token)")
 	regenerateSecret := flag.Bool("regen-secret", false, "Force secret key generation, this will invalidate all previous session!")
+	rotateKey := flag.Bool("rotate-key", false, "Rotate the signing key, previous keys keep working for the grace period set with -rotate-grace")
+	signingAlg := flag.String("signing-alg", auth.AlgHS256, "Algorithm for signing tokens (HS256, RS256 or EdDSA), public keys of RS256/EdDSA keys are served at /.well-known/jwks.json")
+	rotateGrace := flag.Duration("rotate-grace", time.Hour*24*7, "How long the previous signing key keeps verifying tokens after -rotate-key")
 	clearSubscriptions := flag.String("clear-subs", "", "If specified, clear all existing subscription in websocket for user")
+	tokenTTL := flag.String("token-ttl", "", "Access token lifetime per user level in format level=duration, comma separated (eg. admin=1h,streamer=168h)")
+	refreshTTL := flag.Duration("refresh-ttl", auth.DefaultRefreshLifetime, "How long refresh tokens are valid for")
+	backupDir := flag.String("backup-dir", "backups", "Directory to save snapshots created with the backup endpoint to")
+	backupKeep := flag.Int("backup-keep", 7, "How many snapshots to keep in -backup-dir, 0 to keep all of them")
+	migrateDryRun := flag.Bool("migrate-dry-run", false, "Report the database migrations that would be applied and exit without changing anything")
+	trustProxy := flag.Bool("trust-proxy", false, "Trust X-Forwarded-For/X-Real-IP headers for client addresses (only enable behind a reverse proxy)")
 	flag.Parse()
 
-	if *debug {
-		var err error
-		log, err = zap.NewDevelopment()
-		failOnError(err, "Failed to create logger")
-	} else {
-		var err error
-		log, err = zap.NewProduction()
-		failOnError(err, "Failed to create logger")
-	}
+	initLogger(*debug)
 
-	// Open DB
-	dbclient, err := badger.Open(badger.DefaultOptions(*dbdir).WithSyncWrites(true))
-	failOnError(err, "Could not open DB")
-	defer dbclient.Close()
+	tokenLifetimes, err := parseTokenTTL(*tokenTTL)
+	failOnError(err, "Invalid -token-ttl")
 
-	// Initialize KV (required)
-	hub, err := kv.NewHub(badger_driver.NewBadgerBackend(dbclient), kv.HubOptions{}, log.With(zap.String("module", "kv")))
-	failOnError(err, "could not initialize KV hub")
-	go hub.Run()
+	// Startup tasks don't need to be cancelled, DB calls still time out on their own
+	ctx := context.Background()
 
-	// Create DB module
-	db, err := database.NewDBModule(hub, log.With(zap.String("module", "db")))
-	failOnError(err, "could not initialize DB module")
+	store, hub, db := openDatabase(storage.Kind(*storageKind), *dbdir)
+	defer store.Close()
+
+	// Bring stored data up to date before anything reads it
+	applied, err := migrations.Run(ctx, db, migrations.Options{
+		DryRun: *migrateDryRun,
+		Logger: log.With(zap.String("module", "migrations")),
+	})
+	failOnError(err, "Could not migrate database")
+	if *migrateDryRun {
+		log.Info("Dry run complete, no changes were made", zap.Int("pending", len(applied)), zap.Int("schema", migrations.Latest()))
+		return
+	}
 
-	authStore, err := auth.Init(db, auth.Options{
+	authStore, err := auth.Init(ctx, db, auth.Options{
 		Logger:              log.With(zap.String("module", "auth")),
 		ForgeGenerateSecret: *regenerateSecret,
+		SigningAlgorithm:    *signingAlg,
+		TokenLifetimes:      tokenLifetimes,
+		RefreshLifetime:     *refreshTTL,
 	})
 	failOnError(err, "Could not initialize auth store")
 
+	if *rotateKey {
+		key, err := authStore.RotateKey(ctx, *rotateGrace)
+		failOnError(err, "Could not rotate signing key")
+
+		log.Info("Rotated signing key", zap.String("kid", key.ID), zap.Duration("grace", *rotateGrace))
+	}
+
 	if *bootstrap != "" {
 		parts := strings.SplitN(*bootstrap, ":", 2)
 		if len(parts) < 2 || len(parts[0]) < 1 || len(parts[1]) < 1 {
@@ -66,7 +107,7 @@ func main() {
 		}
 
 		// Add administrator
-		failOnError(authStore.AddUser(parts[0], parts[1], auth.ULAdmin), "Error adding admin user")
+		failOnError(authStore.AddUser(ctx, parts[0], parts[1], auth.ULAdmin), "Error adding admin user")
 
 		log.Info("Created admin user", zap.String("user", parts[0]))
 	} else {
@@ -97,11 +138,23 @@ func main() {
 		fatalError(fmt.Errorf("WEBHOOK_URI env var must be set to a valid URL on which the stulbe host is reacheable (eg. https://stulbe.your.tld/webhook"), "Missing configuration")
 	}
 
+	// Backups and garbage collection are specific to badger
+	var backups *backup.Manager
+	badgerStore, isBadger := store.(*storage.Badger)
+	if isBadger {
+		backups, err = backup.NewManager(badgerStore.DB, *backupDir, *backupKeep, log.With(zap.String("module", "backup")))
+		failOnError(err, "Could not create backup directory")
+	} else {
+		log.Info("Backups are only available with badger storage", zap.String("storage", *storageKind))
+	}
+
 	// Create Twitch client
 	backend, err := stulbe.NewBackend(hub, db, authStore, stulbe.BackendConfig{
 		WebhookSecret: webhookSecret,
 		WebhookURL:    webhookURL,
 		RedirectURL:   redirectURL,
+		TrustProxy:    *trustProxy,
+		Backups:       backups,
 		Twitch: &helix.Options{
 			ClientID:     twitchClientID,
 			ClientSecret: twitchClientSecret,
@@ -120,21 +173,76 @@ func main() {
 	}
 
 	// Run garbage collection every once in a while
-	go func() {
-		ticker := time.NewTicker(15 * time.Minute)
-		defer ticker.Stop()
-		for range ticker.C {
-			// Run DB garbage collection until it's done
-			var err error
-			for err == nil {
-				err = dbclient.RunValueLogGC(0.5)
+	if isBadger {
+		go func() {
+			ticker := time.NewTicker(15 * time.Minute)
+			defer ticker.Stop()
+			for range ticker.C {
+				badgerStore.RunGC()
 			}
-		}
-	}()
+		}()
+	}
 
 	fatalError(backend.RunHTTPServer(*bind), "HTTP server died unexepectedly")
 }
 
+func initLogger(debug bool) {
+	var err error
+	if debug {
+		log, err = zap.NewDevelopment()
+	} else {
+		log, err = zap.NewProduction()
+	}
+	failOnError(err, "Failed to create logger")
+}
+
+const storageUsage = "Storage backend (badger, bolt or memory), -dbfile is a directory for badger and a file for bolt"
+
+// openDatabase opens the storage at dbfile and starts a KV hub on it
+func openDatabase(kind storage.Kind, dbfile string) (storage.Storage, *kv.Hub, *database.DBModule) {
+	// Open DB
+	store, err := storage.Open(kind, dbfile)
+	failOnError(err, "Could not open DB")
+	if kind == storage.KindMemory {
+		log.Warn("Using in-memory storage, all data will be lost on exit!")
+	}
+
+	// Initialize KV (required)
+	hub, err := kv.NewHub(store, kv.HubOptions{}, log.With(zap.String("module", "kv")))
+	failOnError(err, "could not initialize KV hub")
+	go hub.Run()
+
+	// Create DB module
+	db, err := database.NewDBModule(hub, log.With(zap.String("module", "db")))
+	failOnError(err, "could not initialize DB module")
+
+	return store, hub, db
+}
+
+// parseTokenTTL parses a list of level=duration pairs
+func parseTokenTTL(value string) (map[auth.UserLevel]time.Duration, error) {
+	lifetimes := make(map[auth.UserLevel]time.Duration)
+	if value == "" {
+		return lifetimes, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("expected level=duration, got %q", pair)
+		}
+		level := auth.UserLevel(strings.TrimSpace(parts[0]))
+		if !level.Valid() {
+			return nil, fmt.Errorf("unknown user level %q", level)
+		}
+		lifetime, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil || lifetime <= 0 {
+			return nil, fmt.Errorf("invalid duration for %s: %q", level, parts[1])
+		}
+		lifetimes[level] = lifetime
+	}
+	return lifetimes, nil
+}
+
 func failOnError(err error, text string) {
 	if err != nil {
 		fatalError(err, text)
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"go.uber.org/zap"
+
+	"github.com/strimertul/stulbe/storage"
+)
+
+// runMigrateStorage implements "stulbe migrate-storage", which copies every key from one storage to another
+func runMigrateStorage(args []string) error {
+	flags := flag.NewFlagSet("migrate-storage", flag.ExitOnError)
+	debug := flags.Bool("debug", false, "Enable debug logging")
+	from := flags.String("from", "", "Storage to copy from, in format kind:path (eg. badger:data)")
+	to := flags.String("to", "", "Storage to copy to, in format kind:path (eg. bolt:stulbe.db)")
+	force := flags.Bool("force", false, "Copy even if the destination already has data, overwriting keys that exist in both")
+	_ = flags.Parse(args)
+
+	initLogger(*debug)
+	if *from == "" || *to == "" {
+		return fmt.Errorf("-from and -to are required")
+	}
+
+	fromKind, fromPath, err := storage.ParseLocation(*from)
+	if err != nil {
+		return fmt.Errorf("invalid -from: %w", err)
+	}
+	toKind, toPath, err := storage.ParseLocation(*to)
+	if err != nil {
+		return fmt.Errorf("invalid -to: %w", err)
+	}
+	if fromKind == storage.KindMemory || toKind == storage.KindMemory {
+		return fmt.Errorf("in-memory storage doesn't persist anything")
+	}
+
+	source, err := storage.Open(fromKind, fromPath)
+	if err != nil {
+		return fmt.Errorf("could not open source storage: %w", err)
+	}
+	defer source.Close()
+
+	destination, err := storage.Open(toKind, toPath)
+	if err != nil {
+		return fmt.Errorf("could not open destination storage: %w", err)
+	}
+	defer destination.Close()
+
+	copied, err := storage.Copy(source, destination, *force)
+	if err != nil {
+		return fmt.Errorf("could not copy keys: %w", err)
+	}
+
+	log.Info("Migrated storage", zap.String("from", *from), zap.String("to", *to), zap.Int("keys", copied))
+	return nil
+}
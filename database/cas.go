@@ -0,0 +1,186 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"reflect"
+
+	kv "github.com/strimertul/kilovolt/v8"
+)
+
+var (
+	// ErrVersionMismatch is returned when a key changed since it was read
+	ErrVersionMismatch = errors.New("key was modified concurrently")
+	// ErrTooManyConflicts is returned when an update keeps failing because of concurrent changes
+	ErrTooManyConflicts = errors.New("too many concurrent modifications")
+)
+
+// How many times Update retries before giving up
+const maxUpdateAttempts = 10
+
+// Version identifies the value of a key at the time it was read, keys that
+// don't exist have an empty version.
+//
+// Only writes made through DBModule are serialized with conditional writes,
+// clients writing directly to the hub (eg. websocket clients) can still
+// change keys in between, but those will still be detected as a version
+// mismatch by CompareAndSwap.
+type Version string
+
+func versionOf(value string) Version {
+	if value == "" {
+		return ""
+	}
+	hash := sha256.Sum256([]byte(value))
+	return Version(hex.EncodeToString(hash[:]))
+}
+
+// UpdateFunc receives the current value of a key (empty if it doesn't exist)
+// and returns its new value, returning an empty value removes the key
+type UpdateFunc func(value string) (string, error)
+
+// TransactionFunc receives the current values of the keys in a transaction
+// (empty for keys that don't exist) and returns the keys to change, empty
+// values remove the key
+type TransactionFunc func(values map[string]string) (map[string]string, error)
+
+// GetKeyVersioned returns the value of a key along with its version, keys
+// that don't exist have an empty value and version
+func (mod *DBModule) GetKeyVersioned(ctx context.Context, key string) (string, Version, error) {
+	value, err := mod.GetKey(ctx, key)
+	if err != nil {
+		if err == kv.ErrorKeyNotFound {
+			return "", "", nil
+		}
+		return "", "", err
+	}
+	return value, versionOf(value), nil
+}
+
+// CompareAndSwap writes a key only if it still has the given version,
+// returning ErrVersionMismatch otherwise. Writing an empty value removes the key.
+func (mod *DBModule) CompareAndSwap(ctx context.Context, key string, version Version, value string) error {
+	if err := mod.lock(ctx); err != nil {
+		return err
+	}
+	defer mod.unlock()
+
+	return mod.compareAndSwap(ctx, key, version, value)
+}
+
+func (mod *DBModule) compareAndSwap(ctx context.Context, key string, version Version, value string) error {
+	_, current, err := mod.GetKeyVersioned(ctx, key)
+	if err != nil {
+		return err
+	}
+	if current != version {
+		return ErrVersionMismatch
+	}
+	if value == "" {
+		if current == "" {
+			return nil
+		}
+		return mod.removeKey(ctx, key)
+	}
+	return mod.putKey(ctx, key, value)
+}
+
+// Update applies fn to the value of a key, retrying if the key is changed
+// concurrently. fn can be called more than once and must not have side effects.
+func (mod *DBModule) Update(ctx context.Context, key string, fn UpdateFunc) error {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		value, version, err := mod.GetKeyVersioned(ctx, key)
+		if err != nil {
+			return err
+		}
+		newValue, err := fn(value)
+		if err != nil {
+			return err
+		}
+		err = mod.CompareAndSwap(ctx, key, version, newValue)
+		if err != ErrVersionMismatch {
+			return err
+		}
+	}
+	return ErrTooManyConflicts
+}
+
+// UpdateJSON decodes a key into dst (which is reset to its zero value if the
+// key doesn't exist), calls fn to modify it and writes it back, retrying if
+// the key is changed concurrently. fn receives whether the key exists.
+func (mod *DBModule) UpdateJSON(ctx context.Context, key string, dst interface{}, fn func(found bool) error) error {
+	target := reflect.ValueOf(dst).Elem()
+	return mod.Update(ctx, key, func(value string) (string, error) {
+		// Start from scratch on every attempt
+		target.Set(reflect.Zero(target.Type()))
+		found := value != ""
+		if found {
+			err := json.Unmarshal([]byte(value), dst)
+			if err != nil {
+				return "", err
+			}
+		}
+		err := fn(found)
+		if err != nil {
+			return "", err
+		}
+		byt, err := json.Marshal(dst)
+		return string(byt), err
+	})
+}
+
+// Transaction reads a set of keys and applies the changes fn returns for them.
+// No other write made through DBModule can happen while the transaction is
+// running, so fn must not write to the DB itself.
+//
+// Writes are sent in a single bulk request, removals are applied one by one
+// after it, so a failure can leave the writes applied and only some of the
+// keys removed. Clients writing directly to the hub can also see the changes
+// half applied.
+func (mod *DBModule) Transaction(ctx context.Context, keys []string, fn TransactionFunc) error {
+	if err := mod.lock(ctx); err != nil {
+		return err
+	}
+	defer mod.unlock()
+
+	values := make(map[string]string)
+	for _, key := range keys {
+		value, _, err := mod.GetKeyVersioned(ctx, key)
+		if err != nil {
+			return err
+		}
+		values[key] = value
+	}
+
+	changes, err := fn(values)
+	if err != nil {
+		return err
+	}
+
+	writes := make(map[string]string)
+	var removals []string
+	for key, value := range changes {
+		if value == "" {
+			removals = append(removals, key)
+		} else {
+			writes[key] = value
+		}
+	}
+
+	// Writes go through a single bulk request so they are applied together
+	if len(writes) > 0 {
+		err = mod.putBulk(ctx, writes)
+		if err != nil {
+			return err
+		}
+	}
+	for _, key := range removals {
+		err = mod.removeKey(ctx, key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package database_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	kv "github.com/strimertul/kilovolt/v8"
+
+	"github.com/strimertul/stulbe/database"
+	"github.com/strimertul/stulbe/internal/dbtest"
+)
+
+func TestCompareAndSwap(t *testing.T) {
+	ctx := context.Background()
+	db := dbtest.New(t)
+
+	// Missing keys have an empty version
+	err := db.CompareAndSwap(ctx, "key", "", "first")
+	if err != nil {
+		t.Fatalf("creating key: %s", err)
+	}
+	value, version, err := db.GetKeyVersioned(ctx, "key")
+	if err != nil {
+		t.Fatalf("reading key: %s", err)
+	}
+	if value != "first" || version == "" {
+		t.Fatalf("expected first with a version, got %q (version %q)", value, version)
+	}
+
+	err = db.CompareAndSwap(ctx, "key", version, "second")
+	if err != nil {
+		t.Fatalf("updating key: %s", err)
+	}
+
+	// The version read before the last write is now stale
+	err = db.CompareAndSwap(ctx, "key", version, "third")
+	if err != database.ErrVersionMismatch {
+		t.Fatalf("expected version mismatch with a stale version, got %v", err)
+	}
+	err = db.CompareAndSwap(ctx, "key", "", "third")
+	if err != database.ErrVersionMismatch {
+		t.Fatalf("expected version mismatch creating an existing key, got %v", err)
+	}
+	value, err = db.GetKey(ctx, "key")
+	if err != nil || value != "second" {
+		t.Fatalf("expected second after failed swaps, got %q (%v)", value, err)
+	}
+
+	// Empty values remove the key
+	_, version, err = db.GetKeyVersioned(ctx, "key")
+	if err != nil {
+		t.Fatalf("reading key: %s", err)
+	}
+	err = db.CompareAndSwap(ctx, "key", version, "")
+	if err != nil {
+		t.Fatalf("removing key: %s", err)
+	}
+	_, err = db.GetKey(ctx, "key")
+	if err != kv.ErrorKeyNotFound {
+		t.Fatalf("expected key to be removed, got %v", err)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	ctx := context.Background()
+	db := dbtest.New(t)
+
+	for i := 0; i < 3; i++ {
+		err := db.Update(ctx, "counter", func(value string) (string, error) {
+			return value + "x", nil
+		})
+		if err != nil {
+			t.Fatalf("updating key: %s", err)
+		}
+	}
+	value, err := db.GetKey(ctx, "counter")
+	if err != nil || value != "xxx" {
+		t.Fatalf("expected xxx, got %q (%v)", value, err)
+	}
+}
+
+func TestUpdateTooManyConflicts(t *testing.T) {
+	ctx := context.Background()
+	db := dbtest.New(t)
+
+	// Change the key behind Update's back on every attempt
+	attempts := 0
+	err := db.Update(ctx, "key", func(value string) (string, error) {
+		attempts++
+		if err := db.PutKey(ctx, "key", fmt.Sprintf("other-%d", attempts)); err != nil {
+			return "", err
+		}
+		return "mine", nil
+	})
+	if err != database.ErrTooManyConflicts {
+		t.Fatalf("expected too many conflicts, got %v", err)
+	}
+	if attempts != database.MaxUpdateAttempts {
+		t.Fatalf("expected %d attempts, got %d", database.MaxUpdateAttempts, attempts)
+	}
+
+	value, err := db.GetKey(ctx, "key")
+	if err != nil || value != fmt.Sprintf("other-%d", attempts) {
+		t.Fatalf("expected the last concurrent write to be kept, got %q (%v)", value, err)
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	ctx := context.Background()
+	db := dbtest.New(t)
+
+	if err := db.PutKey(ctx, "a", "1"); err != nil {
+		t.Fatalf("writing key: %s", err)
+	}
+	if err := db.PutKey(ctx, "b", "2"); err != nil {
+		t.Fatalf("writing key: %s", err)
+	}
+
+	err := db.Transaction(ctx, []string{"a", "b", "c"}, func(values map[string]string) (map[string]string, error) {
+		if values["a"] != "1" || values["b"] != "2" || values["c"] != "" {
+			return nil, fmt.Errorf("unexpected values: %v", values)
+		}
+		return map[string]string{
+			"a": "",
+			"c": "3",
+		}, nil
+	})
+	if err != nil {
+		t.Fatalf("running transaction: %s", err)
+	}
+
+	expected := map[string]string{"b": "2", "c": "3"}
+	data, err := db.GetAll(ctx, "")
+	if err != nil {
+		t.Fatalf("reading keys: %s", err)
+	}
+	for key, value := range expected {
+		if data[key] != value {
+			t.Errorf("expected %s to be %q, got %q", key, value, data[key])
+		}
+	}
+	if data["a"] != "" {
+		t.Errorf("expected a to be removed, got %q", data["a"])
+	}
+}
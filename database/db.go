@@ -1,7 +1,9 @@
 package database
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	jsoniter "github.com/json-iterator/go"
 	kv "github.com/strimertul/kilovolt/v8"
@@ -15,10 +17,21 @@ var (
 	ErrUnknown = fmt.Errorf("unknown error")
 )
 
+// DefaultTimeout bounds requests made with a context that has no deadline
+const DefaultTimeout = 10 * time.Second
+
 type DBModule struct {
 	client *kv.LocalClient
 	hub    *kv.Hub
 	logger *zap.Logger
+
+	// Serializes writes so that conditional updates can't interleave with
+	// other writes made through the module, used as a mutex that can be
+	// waited on with a context
+	writeMu chan struct{}
+
+	// Closed to stop removing expired keys
+	stop chan struct{}
 }
 
 type KvPair struct {
@@ -29,6 +42,12 @@ type KvPair struct {
 func NewDBModule(hub *kv.Hub, logger *zap.Logger) (*DBModule, error) {
 	localClient := kv.NewLocalClient(kv.ClientOptions{}, logger)
 	go localClient.Run()
+	// Pushes are delivered through subscription callbacks, nobody reads the
+	// channel so drain it to keep the client from blocking once it fills up
+	go func() {
+		for range localClient.Pushes {
+		}
+	}()
 	hub.AddClient(localClient)
 	localClient.Wait()
 	err := hub.SetAuthenticated(localClient.UID(), true)
@@ -36,10 +55,13 @@ func NewDBModule(hub *kv.Hub, logger *zap.Logger) (*DBModule, error) {
 		return nil, err
 	}
 	module := &DBModule{
-		client: localClient,
-		hub:    hub,
-		logger: logger,
+		client:  localClient,
+		hub:     hub,
+		logger:  logger,
+		writeMu: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
 	}
+	go module.runSweeper()
 
 	return module, nil
 }
@@ -49,26 +71,41 @@ func (mod *DBModule) Hub() *kv.Hub {
 }
 
 func (mod *DBModule) Close() error {
+	close(mod.stop)
 	mod.hub.RemoveClient(mod.client)
 	return nil
 }
 
-func (mod *DBModule) GetKey(key string) (string, error) {
-	res, err := mod.makeRequest(kv.CmdReadKey, map[string]interface{}{"key": key})
+func (mod *DBModule) GetKey(ctx context.Context, key string) (string, error) {
+	res, err := mod.makeRequest(ctx, kv.CmdReadKey, map[string]interface{}{"key": key})
 	if err != nil {
 		return "", err
 	}
-	return res.Data.(string), nil
+	// Kilovolt replies with an empty string for keys that don't exist
+	data, _ := res.Data.(string)
+	if data == "" {
+		return "", kv.ErrorKeyNotFound
+	}
+	return data, nil
 }
 
-func (mod *DBModule) PutKey(key string, data string) error {
-	_, err := mod.makeRequest(kv.CmdWriteKey, map[string]interface{}{"key": key, "data": data})
+func (mod *DBModule) PutKey(ctx context.Context, key string, data string) error {
+	if err := mod.lock(ctx); err != nil {
+		return err
+	}
+	defer mod.unlock()
+
+	return mod.putKey(ctx, key, data)
+}
+
+func (mod *DBModule) putKey(ctx context.Context, key string, data string) error {
+	_, err := mod.makeRequest(ctx, kv.CmdWriteKey, map[string]interface{}{"key": key, "data": data})
 	return err
 }
 
-func (mod *DBModule) Subscribe(fn kv.SubscriptionCallback, prefixes ...string) error {
+func (mod *DBModule) Subscribe(ctx context.Context, fn kv.SubscriptionCallback, prefixes ...string) error {
 	for _, prefix := range prefixes {
-		_, err := mod.makeRequest(kv.CmdSubscribePrefix, map[string]interface{}{"prefix": prefix})
+		_, err := mod.makeRequest(ctx, kv.CmdSubscribePrefix, map[string]interface{}{"prefix": prefix})
 		if err != nil {
 			return err
 		}
@@ -77,16 +114,16 @@ func (mod *DBModule) Subscribe(fn kv.SubscriptionCallback, prefixes ...string) e
 	return nil
 }
 
-func (mod *DBModule) GetJSON(key string, dst interface{}) error {
-	res, err := mod.GetKey(key)
+func (mod *DBModule) GetJSON(ctx context.Context, key string, dst interface{}) error {
+	res, err := mod.GetKey(ctx, key)
 	if err != nil {
 		return err
 	}
 	return json.Unmarshal([]byte(res), dst)
 }
 
-func (mod *DBModule) GetAll(prefix string) (map[string]string, error) {
-	res, err := mod.makeRequest(kv.CmdReadPrefix, map[string]interface{}{"prefix": prefix})
+func (mod *DBModule) GetAll(ctx context.Context, prefix string) (map[string]string, error) {
+	res, err := mod.makeRequest(ctx, kv.CmdReadPrefix, map[string]interface{}{"prefix": prefix})
 	if err != nil {
 		return nil, err
 	}
@@ -98,17 +135,17 @@ func (mod *DBModule) GetAll(prefix string) (map[string]string, error) {
 	return out, nil
 }
 
-func (mod *DBModule) PutJSON(key string, data interface{}) error {
+func (mod *DBModule) PutJSON(ctx context.Context, key string, data interface{}) error {
 	byt, err := json.Marshal(data)
 	if err != nil {
 		return err
 	}
 
-	return mod.PutKey(key, string(byt))
+	return mod.PutKey(ctx, key, string(byt))
 }
 
-func (mod *DBModule) PutJSONBulk(kvs map[string]interface{}) error {
-	encoded := make(map[string]interface{})
+func (mod *DBModule) PutJSONBulk(ctx context.Context, kvs map[string]interface{}) error {
+	encoded := make(map[string]string)
 	for k, v := range kvs {
 		byt, err := json.Marshal(v)
 		if err != nil {
@@ -116,20 +153,104 @@ func (mod *DBModule) PutJSONBulk(kvs map[string]interface{}) error {
 		}
 		encoded[k] = string(byt)
 	}
-	_, chn := mod.client.MakeRequest(kv.CmdWriteBulk, encoded)
-	_, err := getResponse(<-chn)
+
+	if err := mod.lock(ctx); err != nil {
+		return err
+	}
+	defer mod.unlock()
+
+	return mod.putBulk(ctx, encoded)
+}
+
+func (mod *DBModule) putBulk(ctx context.Context, kvs map[string]string) error {
+	data := make(map[string]interface{})
+	for k, v := range kvs {
+		data[k] = v
+	}
+	_, err := mod.makeRequest(ctx, kv.CmdWriteBulk, data)
 	return err
 }
 
-func (mod *DBModule) RemoveKey(key string) error {
-	// TODO
-	return mod.PutKey(key, "")
+func (mod *DBModule) RemoveKey(ctx context.Context, key string) error {
+	if err := mod.lock(ctx); err != nil {
+		return err
+	}
+	defer mod.unlock()
+
+	return mod.removeKey(ctx, key)
+}
+
+func (mod *DBModule) removeKey(ctx context.Context, key string) error {
+	_, err := mod.makeRequest(ctx, kv.CmdRemoveKey, map[string]interface{}{"key": key})
+	return err
 }
 
-func (mod *DBModule) makeRequest(cmd string, data map[string]interface{}) (kv.Response, error) {
+// ListKeys returns the keys starting with prefix
+func (mod *DBModule) ListKeys(ctx context.Context, prefix string) ([]string, error) {
+	res, err := mod.makeRequest(ctx, kv.CmdListKeys, map[string]interface{}{"prefix": prefix})
+	if err != nil {
+		return nil, err
+	}
+
+	keys, _ := res.Data.([]interface{})
+	out := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if str, ok := key.(string); ok {
+			out = append(out, str)
+		}
+	}
+	return out, nil
+}
+
+// RemoveAll removes every key starting with prefix, returning how many were removed
+func (mod *DBModule) RemoveAll(ctx context.Context, prefix string) (int, error) {
+	keys, err := mod.ListKeys(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+	for i, key := range keys {
+		err = mod.RemoveKey(ctx, key)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(keys), nil
+}
+
+// lock acquires the write lock, giving up if ctx is done first
+func (mod *DBModule) lock(ctx context.Context) error {
+	select {
+	case mod.writeMu <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return &TimeoutError{Command: "lock", Err: ctx.Err()}
+	}
+}
+
+func (mod *DBModule) unlock() {
+	<-mod.writeMu
+}
+
+func (mod *DBModule) makeRequest(ctx context.Context, cmd string, data map[string]interface{}) (kv.Response, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultTimeout)
+		defer cancel()
+	}
+	if err := ctx.Err(); err != nil {
+		return kv.Response{}, &TimeoutError{Command: cmd, Err: err}
+	}
+
 	req, chn := mod.client.MakeRequest(cmd, data)
-	mod.hub.SendMessage(req)
-	return getResponse(<-chn)
+	// Sending blocks if the hub is stuck, the response channel is buffered
+	// so the request can be abandoned safely once ctx is done
+	go mod.hub.SendMessage(req)
+	select {
+	case response := <-chn:
+		return getResponse(response)
+	case <-ctx.Done():
+		return kv.Response{}, &TimeoutError{Command: cmd, Err: ctx.Err()}
+	}
 }
 
 func getResponse(response interface{}) (kv.Response, error) {
@@ -149,3 +270,23 @@ type KvError struct {
 func (kv *KvError) Error() string {
 	return fmt.Sprintf("%s: %s", kv.ErrorData.Error, kv.ErrorData.Details)
 }
+
+// TimeoutError is returned when a request is cancelled or doesn't get a
+// response before its deadline
+type TimeoutError struct {
+	Command string
+	Err     error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Command, e.Err.Error())
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout returns true if the deadline was exceeded, false if the request was cancelled
+func (e *TimeoutError) Timeout() bool {
+	return e.Err == context.DeadlineExceeded
+}
@@ -0,0 +1,7 @@
+package database
+
+// Internals used by the tests in database_test
+const (
+	MaxUpdateAttempts = maxUpdateAttempts
+	TTLPrefix         = ttlPrefix
+)
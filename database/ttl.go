@@ -0,0 +1,190 @@
+package database
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	kv "github.com/strimertul/kilovolt/v8"
+	"go.uber.org/zap"
+)
+
+// Keys written with a TTL have their expiry saved under this prefix followed
+// by the key, so that it works the same with every storage
+const ttlPrefix = "stulbe-meta/ttl/"
+
+// How often expired keys are removed, keys can outlive their TTL by up to this long
+const ttlSweepInterval = 30 * time.Second
+
+// ttlEntry is the expiry of a key, only valid for the value it was set for.
+// Writing the key again without a TTL changes its version and cancels the expiry.
+type ttlEntry struct {
+	ExpiresAt time.Time `json:"expires_at"`
+	Version   Version   `json:"version"`
+}
+
+// PutKeyTTL writes a key that is removed once ttl has passed. Removal goes
+// through the hub, so subscribers see it like any other deletion.
+func (mod *DBModule) PutKeyTTL(ctx context.Context, key string, data string, ttl time.Duration) error {
+	entry, err := json.Marshal(ttlEntry{
+		ExpiresAt: time.Now().Add(ttl),
+		Version:   versionOf(data),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := mod.lock(ctx); err != nil {
+		return err
+	}
+	defer mod.unlock()
+
+	// Write the key and its expiry together so that one never exists without the other
+	return mod.putBulk(ctx, map[string]string{
+		key:             data,
+		ttlPrefix + key: string(entry),
+	})
+}
+
+func (mod *DBModule) PutJSONTTL(ctx context.Context, key string, data interface{}, ttl time.Duration) error {
+	byt, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	return mod.PutKeyTTL(ctx, key, string(byt), ttl)
+}
+
+// CompareAndSwapTTL is like CompareAndSwap, but the new value is removed once
+// ttl has passed. The value can't be empty.
+func (mod *DBModule) CompareAndSwapTTL(ctx context.Context, key string, version Version, value string, ttl time.Duration) error {
+	entry, err := json.Marshal(ttlEntry{
+		ExpiresAt: time.Now().Add(ttl),
+		Version:   versionOf(value),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := mod.lock(ctx); err != nil {
+		return err
+	}
+	defer mod.unlock()
+
+	_, current, err := mod.GetKeyVersioned(ctx, key)
+	if err != nil {
+		return err
+	}
+	if current != version {
+		return ErrVersionMismatch
+	}
+	return mod.putBulk(ctx, map[string]string{
+		key:             value,
+		ttlPrefix + key: string(entry),
+	})
+}
+
+// Expire sets a TTL on the current value of a key, returning kv.ErrorKeyNotFound
+// if it doesn't exist
+func (mod *DBModule) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	if err := mod.lock(ctx); err != nil {
+		return err
+	}
+	defer mod.unlock()
+
+	_, version, err := mod.GetKeyVersioned(ctx, key)
+	if err != nil {
+		return err
+	}
+	if version == "" {
+		return kv.ErrorKeyNotFound
+	}
+
+	entry, err := json.Marshal(ttlEntry{
+		ExpiresAt: time.Now().Add(ttl),
+		Version:   version,
+	})
+	if err != nil {
+		return err
+	}
+	return mod.putKey(ctx, ttlPrefix+key, string(entry))
+}
+
+// RemoveExpired removes every key past its TTL, returning how many were removed
+func (mod *DBModule) RemoveExpired(ctx context.Context) (int, error) {
+	entries, err := mod.GetAll(ctx, ttlPrefix)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	removed := 0
+	for indexKey, value := range entries {
+		var entry ttlEntry
+		if err := json.Unmarshal([]byte(value), &entry); err == nil && entry.ExpiresAt.After(now) {
+			continue
+		}
+		ok, err := mod.expireKey(ctx, strings.TrimPrefix(indexKey, ttlPrefix))
+		if err != nil {
+			return removed, err
+		}
+		if ok {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// expireKey removes a key if it's still past its TTL, returning false if it
+// was written again in the meantime
+func (mod *DBModule) expireKey(ctx context.Context, key string) (bool, error) {
+	if err := mod.lock(ctx); err != nil {
+		return false, err
+	}
+	defer mod.unlock()
+
+	// The expiry might have changed since it was listed
+	value, err := mod.GetKey(ctx, ttlPrefix+key)
+	if err != nil {
+		if err == kv.ErrorKeyNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	var entry ttlEntry
+	if err := json.Unmarshal([]byte(value), &entry); err != nil {
+		mod.logger.Warn("removing invalid ttl entry", zap.String("key", key), zap.Error(err))
+		return false, mod.removeKey(ctx, ttlPrefix+key)
+	}
+	if entry.ExpiresAt.After(time.Now()) {
+		return false, nil
+	}
+
+	// Keys changed after their TTL was set don't expire anymore
+	err = mod.compareAndSwap(ctx, key, entry.Version, "")
+	expired := err == nil
+	if err != nil && err != ErrVersionMismatch {
+		return false, err
+	}
+	return expired, mod.removeKey(ctx, ttlPrefix+key)
+}
+
+func (mod *DBModule) runSweeper() {
+	ticker := time.NewTicker(ttlSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-mod.stop:
+			return
+		case <-ticker.C:
+			removed, err := mod.RemoveExpired(context.Background())
+			if err != nil {
+				mod.logger.Error("could not remove expired keys", zap.Error(err))
+				continue
+			}
+			if removed > 0 {
+				mod.logger.Debug("removed expired keys", zap.Int("removed", removed))
+			}
+		}
+	}
+}
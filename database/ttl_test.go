@@ -0,0 +1,100 @@
+package database_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	kv "github.com/strimertul/kilovolt/v8"
+
+	"github.com/strimertul/stulbe/database"
+	"github.com/strimertul/stulbe/internal/dbtest"
+)
+
+func TestRemoveExpired(t *testing.T) {
+	ctx := context.Background()
+	db := dbtest.New(t)
+
+	if err := db.PutKeyTTL(ctx, "expired", "value", time.Millisecond); err != nil {
+		t.Fatalf("writing key: %s", err)
+	}
+	if err := db.PutKeyTTL(ctx, "live", "value", time.Hour); err != nil {
+		t.Fatalf("writing key: %s", err)
+	}
+	if err := db.PutKey(ctx, "forever", "value"); err != nil {
+		t.Fatalf("writing key: %s", err)
+	}
+	// Writing a key again without a TTL cancels its expiry
+	if err := db.PutKeyTTL(ctx, "rewritten", "old", time.Millisecond); err != nil {
+		t.Fatalf("writing key: %s", err)
+	}
+	if err := db.PutKey(ctx, "rewritten", "new"); err != nil {
+		t.Fatalf("writing key: %s", err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	removed, err := db.RemoveExpired(ctx)
+	if err != nil {
+		t.Fatalf("removing expired keys: %s", err)
+	}
+	if removed != 1 {
+		t.Errorf("expected 1 key to be removed, got %d", removed)
+	}
+
+	if _, err := db.GetKey(ctx, "expired"); err != kv.ErrorKeyNotFound {
+		t.Errorf("expected expired key to be removed, got %v", err)
+	}
+	for _, key := range []string{"live", "forever", "rewritten"} {
+		if _, err := db.GetKey(ctx, key); err != nil {
+			t.Errorf("expected %s to be kept, got %v", key, err)
+		}
+	}
+
+	// Only the index entry of the live key is left
+	index, err := db.ListKeys(ctx, database.TTLPrefix)
+	if err != nil {
+		t.Fatalf("listing ttl entries: %s", err)
+	}
+	if len(index) != 1 || index[0] != database.TTLPrefix+"live" {
+		t.Errorf("expected only the live key in the ttl index, got %v", index)
+	}
+
+	// Nothing else to remove
+	removed, err = db.RemoveExpired(ctx)
+	if err != nil {
+		t.Fatalf("removing expired keys: %s", err)
+	}
+	if removed != 0 {
+		t.Errorf("expected nothing to be removed, got %d", removed)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	ctx := context.Background()
+	db := dbtest.New(t)
+
+	if err := db.Expire(ctx, "missing", time.Millisecond); err != kv.ErrorKeyNotFound {
+		t.Fatalf("expected key not found for a missing key, got %v", err)
+	}
+
+	if err := db.PutKey(ctx, "key", "value"); err != nil {
+		t.Fatalf("writing key: %s", err)
+	}
+	if err := db.Expire(ctx, "key", time.Millisecond); err != nil {
+		t.Fatalf("setting ttl: %s", err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	removed, err := db.RemoveExpired(ctx)
+	if err != nil {
+		t.Fatalf("removing expired keys: %s", err)
+	}
+	if removed != 1 {
+		t.Errorf("expected 1 key to be removed, got %d", removed)
+	}
+	if _, err := db.GetKey(ctx, "key"); err != kv.ErrorKeyNotFound {
+		t.Errorf("expected key to be removed, got %v", err)
+	}
+}
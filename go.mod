@@ -6,11 +6,13 @@ require (
 	github.com/dgraph-io/badger/v3 v3.2103.2
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/gorilla/mux v1.8.0
+	github.com/gorilla/websocket v1.4.2
 	github.com/hashicorp/golang-lru v0.5.4
-	github.com/json-iterator/go v1.1.11
+	github.com/json-iterator/go v1.1.12
 	github.com/nicklaw5/helix/v2 v2.3.0
 	github.com/strimertul/kilovolt/v8 v8.0.3
 	github.com/strimertul/kv-badgerdb v1.2.1
+	go.etcd.io/bbolt v1.3.6
 	go.uber.org/zap v1.21.0
 	golang.org/x/crypto v0.0.0-20210505212654-3497b51f5e64
 )
@@ -0,0 +1,46 @@
+// Package dbtest sets up databases for tests
+package dbtest
+
+import (
+	"testing"
+
+	kv "github.com/strimertul/kilovolt/v8"
+	"go.uber.org/zap"
+
+	"github.com/strimertul/stulbe/database"
+	"github.com/strimertul/stulbe/storage"
+)
+
+// New returns a DBModule on an empty in-memory storage, closed when the test ends
+func New(t testing.TB) *database.DBModule {
+	t.Helper()
+	return NewWithData(t, nil)
+}
+
+// NewWithData is like New, but the storage starts with the given data. It's
+// written directly to the storage, so it can have values DBModule wouldn't
+// write (eg. empty ones).
+func NewWithData(t testing.TB, data map[string]string) *database.DBModule {
+	t.Helper()
+
+	store := storage.NewMemory()
+	if err := store.SetBulk(data); err != nil {
+		t.Fatalf("could not write initial data: %s", err)
+	}
+
+	logger := zap.NewNop()
+	hub, err := kv.NewHub(store, kv.HubOptions{}, logger)
+	if err != nil {
+		t.Fatalf("could not create hub: %s", err)
+	}
+	go hub.Run()
+
+	db, err := database.NewDBModule(hub, logger)
+	if err != nil {
+		t.Fatalf("could not create db module: %s", err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	return db
+}
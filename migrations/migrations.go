@@ -0,0 +1,114 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	kv "github.com/strimertul/kilovolt/v8"
+	"go.uber.org/zap"
+
+	"github.com/strimertul/stulbe/database"
+)
+
+// VersionKey holds the schema version of the data in the database, databases
+// without it are at version 0
+const VersionKey = "stulbe-meta/schema-version"
+
+var (
+	ErrNewerSchema = errors.New("database was written by a newer version of stulbe")
+)
+
+// Migration upgrades stored data from the previous schema version to Version
+type Migration struct {
+	Version     int
+	Description string
+	// Migrate applies the migration and returns how many keys it changed, in
+	// dry runs it must not write anything and only count what it would change
+	Migrate func(ctx context.Context, db *database.DBModule, dryRun bool) (int, error)
+}
+
+// Applied is a migration that was run (or would have been, for dry runs)
+type Applied struct {
+	Version     int
+	Description string
+	Changed     int
+}
+
+type Options struct {
+	// Only report what would change without writing anything. Migrations
+	// see the data as it is, not as previous migrations would have left it.
+	DryRun bool
+	Logger *zap.Logger
+}
+
+// Latest returns the schema version this build writes
+func Latest() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// CurrentVersion returns the schema version of the data in the database
+func CurrentVersion(ctx context.Context, db *database.DBModule) (int, error) {
+	value, err := db.GetKey(ctx, VersionKey)
+	if err != nil {
+		if err == kv.ErrorKeyNotFound {
+			return 0, nil
+		}
+		return 0, err
+	}
+	version, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid schema version %q: %w", value, err)
+	}
+	return version, nil
+}
+
+// Run applies every migration the database hasn't had yet, in order. The
+// schema version is saved after each one, so a failed run can be resumed.
+// Databases from a newer version are refused with ErrNewerSchema.
+func Run(ctx context.Context, db *database.DBModule, options Options) ([]Applied, error) {
+	logger := options.Logger
+	if logger == nil {
+		logger, _ = zap.NewProduction()
+	}
+
+	current, err := CurrentVersion(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	if current > Latest() {
+		return nil, fmt.Errorf("%w (schema version %d, this build supports up to %d)", ErrNewerSchema, current, Latest())
+	}
+
+	var applied []Applied
+	for _, migration := range migrations {
+		if migration.Version <= current {
+			continue
+		}
+
+		changed, err := migration.Migrate(ctx, db, options.DryRun)
+		if err != nil {
+			return applied, fmt.Errorf("migration %d (%s) failed: %w", migration.Version, migration.Description, err)
+		}
+		applied = append(applied, Applied{
+			Version:     migration.Version,
+			Description: migration.Description,
+			Changed:     changed,
+		})
+		logger.Info("applied migration",
+			zap.Int("version", migration.Version),
+			zap.String("description", migration.Description),
+			zap.Int("changed", changed),
+			zap.Bool("dry-run", options.DryRun))
+
+		if options.DryRun {
+			continue
+		}
+		err = db.PutKey(ctx, VersionKey, strconv.Itoa(migration.Version))
+		if err != nil {
+			return applied, err
+		}
+	}
+	return applied, nil
+}
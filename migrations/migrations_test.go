@@ -0,0 +1,132 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/strimertul/stulbe/database"
+	"github.com/strimertul/stulbe/internal/dbtest"
+)
+
+func checkVersion(t *testing.T, db *database.DBModule, expected int) {
+	t.Helper()
+	version, err := CurrentVersion(context.Background(), db)
+	if err != nil {
+		t.Fatalf("reading schema version: %s", err)
+	}
+	if version != expected {
+		t.Errorf("expected schema version %d, got %d", expected, version)
+	}
+}
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+	db := dbtest.NewWithData(t, map[string]string{
+		"removed": "",
+		"kept":    "value",
+	})
+	options := Options{Logger: zap.NewNop()}
+
+	// Dry runs report what would change without writing anything
+	applied, err := Run(ctx, db, Options{DryRun: true, Logger: zap.NewNop()})
+	if err != nil {
+		t.Fatalf("dry run: %s", err)
+	}
+	if len(applied) != len(migrations) || applied[0].Changed != 1 {
+		t.Errorf("expected every migration to be pending with 1 change, got %+v", applied)
+	}
+	checkVersion(t, db, 0)
+	if keys, _ := db.ListKeys(ctx, "removed"); len(keys) != 1 {
+		t.Errorf("expected dry run to keep empty key, got %v", keys)
+	}
+
+	applied, err = Run(ctx, db, options)
+	if err != nil {
+		t.Fatalf("running migrations: %s", err)
+	}
+	if len(applied) != len(migrations) || applied[0].Changed != 1 {
+		t.Errorf("expected every migration to run with 1 change, got %+v", applied)
+	}
+	checkVersion(t, db, Latest())
+	if keys, _ := db.ListKeys(ctx, "removed"); len(keys) != 0 {
+		t.Errorf("expected empty key to be removed, got %v", keys)
+	}
+	if value, err := db.GetKey(ctx, "kept"); err != nil || value != "value" {
+		t.Errorf("expected other keys to be kept, got %q (%v)", value, err)
+	}
+
+	// Nothing left to do on the next run
+	applied, err = Run(ctx, db, options)
+	if err != nil {
+		t.Fatalf("running migrations again: %s", err)
+	}
+	if len(applied) != 0 {
+		t.Errorf("expected no migrations to run again, got %+v", applied)
+	}
+	checkVersion(t, db, Latest())
+}
+
+func TestRunNewerSchema(t *testing.T) {
+	db := dbtest.NewWithData(t, map[string]string{
+		VersionKey: "9999",
+	})
+
+	_, err := Run(context.Background(), db, Options{Logger: zap.NewNop()})
+	if !errors.Is(err, ErrNewerSchema) {
+		t.Fatalf("expected newer schema error, got %v", err)
+	}
+	checkVersion(t, db, 9999)
+}
+
+func TestRunResumesAfterFailure(t *testing.T) {
+	ctx := context.Background()
+	db := dbtest.NewWithData(t, nil)
+
+	calls := make(map[int]int)
+	fail := true
+	migration := func(version int) Migration {
+		return Migration{
+			Version:     version,
+			Description: "test",
+			Migrate: func(ctx context.Context, db *database.DBModule, dryRun bool) (int, error) {
+				calls[version]++
+				if version == 2 && fail {
+					return 0, errors.New("failed")
+				}
+				return version, nil
+			},
+		}
+	}
+
+	original := migrations
+	migrations = []Migration{migration(1), migration(2), migration(3)}
+	defer func() {
+		migrations = original
+	}()
+
+	applied, err := Run(ctx, db, Options{Logger: zap.NewNop()})
+	if err == nil {
+		t.Fatal("expected migration 2 to fail")
+	}
+	if len(applied) != 1 {
+		t.Errorf("expected only migration 1 to be applied, got %+v", applied)
+	}
+	checkVersion(t, db, 1)
+
+	// Only the migrations that didn't complete are run again
+	fail = false
+	applied, err = Run(ctx, db, Options{Logger: zap.NewNop()})
+	if err != nil {
+		t.Fatalf("running migrations: %s", err)
+	}
+	if len(applied) != 2 || applied[0].Version != 2 || applied[1].Version != 3 {
+		t.Errorf("expected migrations 2 and 3 to be applied, got %+v", applied)
+	}
+	checkVersion(t, db, 3)
+	if calls[1] != 1 || calls[2] != 2 || calls[3] != 1 {
+		t.Errorf("unexpected migration calls: %v", calls)
+	}
+}
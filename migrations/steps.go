@@ -0,0 +1,41 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/strimertul/stulbe/database"
+)
+
+// migrations must be sorted by version, with no gaps. Never change a
+// migration once released, add a new one instead.
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "remove empty values left in place of deleted keys",
+		Migrate:     removeEmptyKeys,
+	},
+}
+
+// removeEmptyKeys removes keys with empty values, which older versions left
+// behind in place of deleted keys
+func removeEmptyKeys(ctx context.Context, db *database.DBModule, dryRun bool) (int, error) {
+	data, err := db.GetAll(ctx, "")
+	if err != nil {
+		return 0, err
+	}
+	changed := 0
+	for key, value := range data {
+		if value != "" {
+			continue
+		}
+		changed++
+		if dryRun {
+			continue
+		}
+		err = db.RemoveKey(ctx, key)
+		if err != nil {
+			return changed, err
+		}
+	}
+	return changed, nil
+}
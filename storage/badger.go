@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"github.com/dgraph-io/badger/v3"
+	badger_driver "github.com/strimertul/kv-badgerdb"
+)
+
+// Badger is a storage backed by a Badger database directory
+type Badger struct {
+	badger_driver.Driver
+	DB *badger.DB
+}
+
+func OpenBadger(path string) (*Badger, error) {
+	db, err := badger.Open(badger.DefaultOptions(path).WithSyncWrites(true))
+	if err != nil {
+		return nil, err
+	}
+	return &Badger{
+		Driver: badger_driver.NewBadgerBackend(db),
+		DB:     db,
+	}, nil
+}
+
+func (b *Badger) Close() error {
+	return b.DB.Close()
+}
+
+// RunGC runs the value log garbage collection until there is nothing left to collect
+func (b *Badger) RunGC() {
+	var err error
+	for err == nil {
+		err = b.DB.RunValueLogGC(0.5)
+	}
+}
@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"bytes"
+	"time"
+
+	kv "github.com/strimertul/kilovolt/v8"
+	bolt "go.etcd.io/bbolt"
+)
+
+// All keys are kept in a single bucket
+var boltBucket = []byte("kv")
+
+// Bolt is a storage backed by a single bbolt database file
+type Bolt struct {
+	DB *bolt.DB
+}
+
+func OpenBolt(path string) (*Bolt, error) {
+	// Fail instead of waiting forever if another process has the file open
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &Bolt{DB: db}, nil
+}
+
+func (b *Bolt) Get(key string) (string, error) {
+	var out string
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		// Values are only valid during the transaction, converting copies them
+		value := tx.Bucket(boltBucket).Get([]byte(key))
+		if value == nil {
+			return kv.ErrorKeyNotFound
+		}
+		out = string(value)
+		return nil
+	})
+	return out, err
+}
+
+func (b *Bolt) GetBulk(keys []string) (map[string]string, error) {
+	out := make(map[string]string)
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		for _, key := range keys {
+			// Missing keys are returned as empty, like the other drivers do
+			out[key] = string(bucket.Get([]byte(key)))
+		}
+		return nil
+	})
+	return out, err
+}
+
+func (b *Bolt) GetPrefix(prefix string) (map[string]string, error) {
+	out := make(map[string]string)
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(boltBucket).Cursor()
+		for k, v := cursor.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = cursor.Next() {
+			out[string(k)] = string(v)
+		}
+		return nil
+	})
+	return out, err
+}
+
+func (b *Bolt) Set(key string, value string) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(key), []byte(value))
+	})
+}
+
+func (b *Bolt) SetBulk(kvs map[string]string) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		for key, value := range kvs {
+			err := bucket.Put([]byte(key), []byte(value))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *Bolt) Delete(key string) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(key))
+	})
+}
+
+func (b *Bolt) List(prefix string) ([]string, error) {
+	out := []string{}
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(boltBucket).Cursor()
+		for k, _ := cursor.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = cursor.Next() {
+			out = append(out, string(k))
+		}
+		return nil
+	})
+	return out, err
+}
+
+func (b *Bolt) Close() error {
+	return b.DB.Close()
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	kv "github.com/strimertul/kilovolt/v8"
+)
+
+// Memory is a storage that keeps everything in memory, meant for ephemeral
+// and test deployments
+type Memory struct {
+	data map[string]string
+	mu   sync.RWMutex
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		data: make(map[string]string),
+	}
+}
+
+func (m *Memory) Get(key string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	value, ok := m.data[key]
+	if !ok {
+		return "", kv.ErrorKeyNotFound
+	}
+	return value, nil
+}
+
+func (m *Memory) GetBulk(keys []string) (map[string]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	// Missing keys are returned as empty, like the other drivers do
+	out := make(map[string]string)
+	for _, key := range keys {
+		out[key] = m.data[key]
+	}
+	return out, nil
+}
+
+func (m *Memory) GetPrefix(prefix string) (map[string]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	out := make(map[string]string)
+	for key, value := range m.data {
+		if strings.HasPrefix(key, prefix) {
+			out[key] = value
+		}
+	}
+	return out, nil
+}
+
+func (m *Memory) Set(key string, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.data[key] = value
+	return nil
+}
+
+func (m *Memory) SetBulk(kvs map[string]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, value := range kvs {
+		m.data[key] = value
+	}
+	return nil
+}
+
+func (m *Memory) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.data, key)
+	return nil
+}
+
+func (m *Memory) List(prefix string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	out := []string{}
+	for key := range m.data {
+		if strings.HasPrefix(key, prefix) {
+			out = append(out, key)
+		}
+	}
+	// Keep the same order as the on-disk drivers
+	sort.Strings(out)
+	return out, nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
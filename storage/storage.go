@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	kv "github.com/strimertul/kilovolt/v8"
+)
+
+// Kind is the name of a storage backend, as used in the -storage option
+type Kind string
+
+const (
+	// KindBadger stores data in a Badger database directory
+	KindBadger Kind = "badger"
+	// KindBolt stores data in a single bbolt database file
+	KindBolt Kind = "bolt"
+	// KindMemory keeps everything in memory, data is lost on exit
+	KindMemory Kind = "memory"
+)
+
+// How many keys are copied at once by Copy
+const copyBatchSize = 1000
+
+var (
+	ErrUnknownKind         = errors.New("unknown storage kind")
+	ErrDestinationNotEmpty = errors.New("destination storage already contains data")
+)
+
+// Storage is a kilovolt driver along with the database behind it
+type Storage interface {
+	kv.Driver
+	// Close flushes and closes the database
+	Close() error
+}
+
+// Open opens the storage of the given kind, path is ignored for in-memory storage
+func Open(kind Kind, path string) (Storage, error) {
+	switch kind {
+	case KindBadger:
+		return OpenBadger(path)
+	case KindBolt:
+		return OpenBolt(path)
+	case KindMemory:
+		return NewMemory(), nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownKind, kind)
+}
+
+// ParseLocation parses a storage location in the format kind:path
+func ParseLocation(location string) (Kind, string, error) {
+	parts := strings.SplitN(location, ":", 2)
+	kind := Kind(parts[0])
+	switch kind {
+	case KindBadger, KindBolt:
+		if len(parts) < 2 || parts[1] == "" {
+			return "", "", fmt.Errorf("%s storage requires a path (%s:path)", kind, kind)
+		}
+		return kind, parts[1], nil
+	case KindMemory:
+		return kind, "", nil
+	}
+	return "", "", fmt.Errorf("%w: %s", ErrUnknownKind, kind)
+}
+
+// Copy copies every key from one storage to another, returning how many keys
+// were copied. Unless force is set, copying to a storage that has data is refused.
+func Copy(from kv.Driver, to kv.Driver, force bool) (int, error) {
+	if !force {
+		existing, err := to.List("")
+		if err != nil {
+			return 0, err
+		}
+		if len(existing) > 0 {
+			return 0, ErrDestinationNotEmpty
+		}
+	}
+
+	keys, err := from.List("")
+	if err != nil {
+		return 0, err
+	}
+	for start := 0; start < len(keys); start += copyBatchSize {
+		end := start + copyBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		data, err := from.GetBulk(keys[start:end])
+		if err != nil {
+			return start, err
+		}
+		err = to.SetBulk(data)
+		if err != nil {
+			return start, err
+		}
+	}
+	return len(keys), nil
+}
+
+// Make sure all storages implement the kilovolt driver interface
+var (
+	_ Storage = &Badger{}
+	_ Storage = &Bolt{}
+	_ Storage = &Memory{}
+)
@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	kv "github.com/strimertul/kilovolt/v8"
+)
+
+// openTestStorages returns an empty storage of every kind
+func openTestStorages(t *testing.T) map[Kind]Storage {
+	t.Helper()
+
+	badger, err := OpenBadger(filepath.Join(t.TempDir(), "badger"))
+	if err != nil {
+		t.Fatalf("opening badger: %s", err)
+	}
+	bolt, err := OpenBolt(filepath.Join(t.TempDir(), "stulbe.db"))
+	if err != nil {
+		t.Fatalf("opening bolt: %s", err)
+	}
+	storages := map[Kind]Storage{
+		KindBadger: badger,
+		KindBolt:   bolt,
+		KindMemory: NewMemory(),
+	}
+	t.Cleanup(func() {
+		for _, store := range storages {
+			_ = store.Close()
+		}
+	})
+	return storages
+}
+
+// TestConformance checks that every storage behaves the same way, kilovolt
+// and DBModule rely on these semantics
+func TestConformance(t *testing.T) {
+	for kind, store := range openTestStorages(t) {
+		store := store
+		t.Run(string(kind), func(t *testing.T) {
+			testDriver(t, store)
+		})
+	}
+}
+
+func testDriver(t *testing.T, store kv.Driver) {
+	if _, err := store.Get("missing"); err != kv.ErrorKeyNotFound {
+		t.Errorf("expected key not found for a missing key, got %v", err)
+	}
+
+	if err := store.Set("a/one", "1"); err != nil {
+		t.Fatalf("setting key: %s", err)
+	}
+	if value, err := store.Get("a/one"); err != nil || value != "1" {
+		t.Errorf("expected 1, got %q (%v)", value, err)
+	}
+	// Overwriting replaces the value
+	if err := store.Set("a/one", "uno"); err != nil {
+		t.Fatalf("setting key: %s", err)
+	}
+	if value, err := store.Get("a/one"); err != nil || value != "uno" {
+		t.Errorf("expected uno, got %q (%v)", value, err)
+	}
+
+	err := store.SetBulk(map[string]string{
+		"a/two":   "2",
+		"a/three": "3",
+		"b/one":   "1",
+		"ab":      "not in a/",
+	})
+	if err != nil {
+		t.Fatalf("setting keys: %s", err)
+	}
+
+	bulk, err := store.GetBulk([]string{"a/one", "b/one", "missing"})
+	if err != nil {
+		t.Fatalf("getting keys: %s", err)
+	}
+	// Missing keys are returned as empty values
+	expected := map[string]string{"a/one": "uno", "b/one": "1", "missing": ""}
+	if !reflect.DeepEqual(bulk, expected) {
+		t.Errorf("expected %v, got %v", expected, bulk)
+	}
+
+	prefix, err := store.GetPrefix("a/")
+	if err != nil {
+		t.Fatalf("getting prefix: %s", err)
+	}
+	expected = map[string]string{"a/one": "uno", "a/two": "2", "a/three": "3"}
+	if !reflect.DeepEqual(prefix, expected) {
+		t.Errorf("expected %v, got %v", expected, prefix)
+	}
+
+	keys, err := store.List("a/")
+	if err != nil {
+		t.Fatalf("listing keys: %s", err)
+	}
+	sort.Strings(keys)
+	if expected := []string{"a/one", "a/three", "a/two"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected %v, got %v", expected, keys)
+	}
+	all, err := store.List("")
+	if err != nil {
+		t.Fatalf("listing keys: %s", err)
+	}
+	if len(all) != 5 {
+		t.Errorf("expected 5 keys, got %v", all)
+	}
+	empty, err := store.List("none/")
+	if err != nil {
+		t.Fatalf("listing keys: %s", err)
+	}
+	if empty == nil || len(empty) != 0 {
+		t.Errorf("expected an empty non-nil list, got %#v", empty)
+	}
+
+	if err := store.Delete("a/two"); err != nil {
+		t.Fatalf("deleting key: %s", err)
+	}
+	if _, err := store.Get("a/two"); err != kv.ErrorKeyNotFound {
+		t.Errorf("expected deleted key to be missing, got %v", err)
+	}
+	// Deleting a missing key isn't an error
+	if err := store.Delete("missing"); err != nil {
+		t.Errorf("deleting a missing key: %s", err)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	storages := openTestStorages(t)
+	from := storages[KindBadger]
+	to := storages[KindBolt]
+
+	data := map[string]string{"a": "1", "b/c": "2", "d": "3"}
+	if err := from.SetBulk(data); err != nil {
+		t.Fatalf("setting keys: %s", err)
+	}
+
+	copied, err := Copy(from, to, false)
+	if err != nil {
+		t.Fatalf("copying: %s", err)
+	}
+	if copied != len(data) {
+		t.Errorf("expected %d keys to be copied, got %d", len(data), copied)
+	}
+	all, err := to.GetPrefix("")
+	if err != nil {
+		t.Fatalf("reading keys: %s", err)
+	}
+	if !reflect.DeepEqual(all, data) {
+		t.Errorf("expected %v, got %v", data, all)
+	}
+
+	// The destination now has data
+	if _, err := Copy(from, to, false); err != ErrDestinationNotEmpty {
+		t.Errorf("expected destination not empty, got %v", err)
+	}
+	if _, err := Copy(from, to, true); err != nil {
+		t.Errorf("forced copy: %s", err)
+	}
+}
+
+func TestParseLocation(t *testing.T) {
+	tests := []struct {
+		location string
+		kind     Kind
+		path     string
+		valid    bool
+	}{
+		{"badger:data", KindBadger, "data", true},
+		{"bolt:/var/lib/stulbe.db", KindBolt, "/var/lib/stulbe.db", true},
+		{"memory", KindMemory, "", true},
+		{"memory:ignored", KindMemory, "", true},
+		{"bolt", "", "", false},
+		{"badger:", "", "", false},
+		{"redis:localhost", "", "", false},
+	}
+	for _, test := range tests {
+		kind, path, err := ParseLocation(test.location)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: expected valid=%v, got %v", test.location, test.valid, err)
+			continue
+		}
+		if kind != test.kind || path != test.path {
+			t.Errorf("%s: expected %s:%s, got %s:%s", test.location, test.kind, test.path, kind, path)
+		}
+	}
+}
@@ -8,7 +8,9 @@ import (
 
 	"go.uber.org/zap"
 
+	"github.com/strimertul/stulbe/audit"
 	"github.com/strimertul/stulbe/auth"
+	"github.com/strimertul/stulbe/backup"
 	"github.com/strimertul/stulbe/database"
 
 	lru "github.com/hashicorp/golang-lru"
@@ -21,12 +23,21 @@ type BackendConfig struct {
 	RedirectURL   string
 	WebhookSecret string
 	Twitch        *helix.Options
+
+	// Use X-Forwarded-For/X-Real-IP headers to find the client address,
+	// only enable when running behind a reverse proxy
+	TrustProxy bool
+
+	// Saves database snapshots for the backup endpoints, they are
+	// disabled if not set (eg. for storages other than badger)
+	Backups *backup.Manager
 }
 
 type Backend struct {
 	Hub    *kv.Hub
 	DB     *database.DBModule
 	Auth   *auth.Storage
+	Audit  *audit.Log
 	Log    *zap.Logger
 	Client *helix.Client
 
@@ -88,6 +99,7 @@ func NewBackend(hub *kv.Hub, db *database.DBModule, authStore *auth.Storage, con
 
 	return &Backend{
 		Auth:   authStore,
+		Audit:  audit.New(db, wrapLogger(log, "audit")),
 		Log:    log,
 		Client: client,
 		Hub:    hub,
@@ -113,6 +125,7 @@ func wrapLogger(log *zap.Logger, module string) *zap.Logger {
 	return log.With(zap.String("module", module))
 }
 
-func userNamespace(user string) string {
+// UserNamespace returns the key prefix of a user's data
+func UserNamespace(user string) string {
 	return "@userdata/" + user + "/"
 }
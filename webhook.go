@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"sync"
 
 	"go.uber.org/zap"
 
@@ -22,8 +21,6 @@ type eventSubNotification struct {
 
 const MAX_ARCHIVE = 100
 
-var webhookMutex sync.Mutex
-
 func (b *Backend) webhookCallback(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 
@@ -67,22 +64,24 @@ func (b *Backend) webhookCallback(w http.ResponseWriter, req *http.Request) {
 		}
 		return
 	}
-	webhookMutex.Lock()
-	defer webhookMutex.Unlock()
-	err = b.DB.PutKey(userNamespace(vars["user"])+"stulbe/ev/webhook", string(body))
+	err = b.DB.PutKey(req.Context(), UserNamespace(vars["user"])+"stulbe/ev/webhook", string(body))
 	if err != nil {
 		b.Log.Error("Could not store event in KV", zap.Error(err))
 	}
-	var archive []eventSubNotification
-	err = b.DB.GetJSON(userNamespace(vars["user"])+"stulbe/last-webhooks", &archive)
-	if err != nil {
-		archive = []eventSubNotification{}
-	}
-	archive = append(archive, vals)
-	if len(archive) > MAX_ARCHIVE {
-		archive = archive[len(archive)-MAX_ARCHIVE:]
-	}
-	err = b.DB.PutJSON(userNamespace(vars["user"])+"stulbe/last-webhooks", archive)
+	err = b.DB.Update(req.Context(), UserNamespace(vars["user"])+"stulbe/last-webhooks", func(value string) (string, error) {
+		archive := []eventSubNotification{}
+		if value != "" {
+			if err := jsoniter.ConfigFastest.UnmarshalFromString(value, &archive); err != nil {
+				b.Log.Warn("Resetting invalid webhook archive", zap.Error(err))
+				archive = []eventSubNotification{}
+			}
+		}
+		archive = append(archive, vals)
+		if len(archive) > MAX_ARCHIVE {
+			archive = archive[len(archive)-MAX_ARCHIVE:]
+		}
+		return jsoniter.ConfigFastest.MarshalToString(archive)
+	})
 	if err != nil {
 		b.Log.Error("Could not store archive in KV", zap.Error(err))
 	}
@@ -0,0 +1,307 @@
+package stulbe
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	jsoniter "github.com/json-iterator/go"
+	kv "github.com/strimertul/kilovolt/v8"
+	"go.uber.org/zap"
+
+	"github.com/strimertul/stulbe/api"
+	"github.com/strimertul/stulbe/audit"
+	"github.com/strimertul/stulbe/auth"
+)
+
+const (
+	// Time allowed to write a message to the peer.
+	wsWriteWait = 10 * time.Second
+
+	// Time allowed to read the next pong message from the peer.
+	wsPongWait = 60 * time.Second
+
+	// Send pings to peer with this period. Must be less than pongWait.
+	wsPingPeriod = (wsPongWait * 9) / 10
+
+	// Maximum message size allowed from peer.
+	wsMaxMessageSize = 512000
+)
+
+// Returned to clients trying to access keys outside of their scopes
+const errForbidden kv.ErrCode = "forbidden"
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// Keys that can be written with the loyalty RPC scope
+var loyaltyRPCKeys = []string{api.KVExLoyaltyRedeem, api.KVExLoyaltyContribute}
+
+// wrapWebsocketAuth authorizes websocket connections, either with a token in
+// the Authorization header or with a single-use ticket in the query string
+func (b *Backend) wrapWebsocketAuth(handler http.HandlerFunc) http.HandlerFunc {
+	withToken := b.wrapAnyToken(auth.PermAccount, handler)
+	return func(w http.ResponseWriter, r *http.Request) {
+		ticket := r.URL.Query().Get("ticket")
+		if ticket == "" {
+			withToken(w, r)
+			return
+		}
+
+		claims, err := b.Auth.RedeemWebsocketTicket(r.Context(), ticket)
+		if err != nil {
+			b.audit(r, "", audit.ActionWebsocketConnect, false, err.Error())
+			switch err {
+			case auth.ErrInvalidTicket:
+				jsonErr(w, "invalid ticket", http.StatusUnauthorized)
+			case auth.ErrSessionRevoked:
+				jsonErr(w, "session revoked", http.StatusUnauthorized)
+			default:
+				b.httpLogger.Error("internal error while redeeming ticket", zap.Error(err))
+				jsonErr(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		// Tickets carry the level the token had when they were issued
+		if !claims.Can(auth.PermAccount) {
+			forbidden(w)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), authKey, claims)
+		handler(w, r.WithContext(ctx))
+	}
+}
+
+func (b *Backend) apiWebsocketTicket(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(authKey).(*auth.UserClaims)
+
+	ticket, expiresAt, err := b.Auth.CreateWebsocketTicket(r.Context(), claims)
+	if err != nil {
+		b.httpLogger.Error("internal error while creating ticket", zap.Error(err))
+		serverError(w, err)
+		return
+	}
+
+	jsonResponse(w, api.WebsocketTicketResponse{
+		Ok:        true,
+		Ticket:    ticket,
+		ExpiresAt: expiresAt,
+	})
+}
+
+func (b *Backend) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	// Get user context
+	claims := r.Context().Value(authKey).(*auth.UserClaims)
+
+	namespace, claims, err := b.resolveNamespace(r.Context(), claims, r.URL.Query().Get("namespace"))
+	if err != nil {
+		if err == auth.ErrGrantNotFound {
+			b.audit(r, claims.User, audit.ActionWebsocketConnect, false, "no grant for namespace "+namespace)
+		}
+		b.namespaceError(w, err)
+		return
+	}
+	details := ""
+	if namespace != claims.User {
+		details = "namespace " + namespace
+	}
+
+	options := kv.ClientOptions{
+		Namespace: UserNamespace(namespace),
+	}
+	b.audit(r, claims.User, audit.ActionWebsocketConnect, true, details)
+
+	// Full access tokens can talk to the hub directly
+	if !claims.Scoped() {
+		b.Hub.CreateWebsocketClient(w, r, options)
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		b.httpLogger.Error("error starting websocket session", zap.Error(err))
+		return
+	}
+	client := &scopedClient{
+		hub:     b.Hub,
+		conn:    conn,
+		send:    make(chan []byte, 256),
+		options: options,
+		claims:  claims,
+		logger:  b.httpLogger,
+	}
+	b.Hub.AddClient(client)
+
+	go client.writePump()
+	go client.readPump()
+}
+
+// scopedClient is a kilovolt websocket client that checks every request
+// against the scopes of the token it was opened with before forwarding it
+type scopedClient struct {
+	hub     *kv.Hub
+	uid     int64
+	conn    *websocket.Conn
+	send    chan []byte
+	options kv.ClientOptions
+	claims  *auth.UserClaims
+	logger  *zap.Logger
+}
+
+func (c *scopedClient) readPump() {
+	defer func() {
+		c.hub.RemoveClient(c)
+		c.conn.Close()
+	}()
+	c.conn.SetReadLimit(wsMaxMessageSize)
+	_ = c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error { return c.conn.SetReadDeadline(time.Now().Add(wsPongWait)) })
+	for {
+		_, message, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				c.logger.Info("abnormal close from client", zap.Error(err), zap.String("client", c.conn.RemoteAddr().String()))
+			}
+			break
+		}
+		message = bytes.TrimSpace(bytes.Replace(message, []byte{'\n'}, []byte{' '}, -1))
+
+		var request kv.Request
+		err = jsoniter.ConfigFastest.Unmarshal(message, &request)
+		if err != nil {
+			c.SendJSON(kv.Error{Ok: false, Error: kv.ErrInvalidFmt, Details: err.Error()})
+			continue
+		}
+		if !c.allowed(request) {
+			c.SendJSON(kv.Error{Ok: false, Error: errForbidden, Details: "token scopes don't allow this operation", RequestID: request.RequestID})
+			continue
+		}
+
+		c.hub.SendMessage(kv.Message{Client: c, Data: message})
+	}
+}
+
+func (c *scopedClient) writePump() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+	for {
+		select {
+		case message, ok := <-c.send:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if !ok {
+				// The hub closed the channel.
+				_ = c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+		case <-ticker.C:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// allowed checks if a request only touches keys the token has access to
+func (c *scopedClient) allowed(request kv.Request) bool {
+	str := func(name string) (string, bool) {
+		value, ok := request.Data[name].(string)
+		return value, ok
+	}
+
+	switch request.CmdName {
+	case kv.CmdReadKey, kv.CmdSubscribeKey, kv.CmdUnsubscribeKey:
+		key, ok := str("key")
+		return ok && c.claims.CanRead(key)
+	case kv.CmdReadPrefix, kv.CmdSubscribePrefix, kv.CmdUnsubscribePrefix:
+		prefix, ok := str("prefix")
+		return ok && c.claims.CanRead(prefix)
+	case kv.CmdListKeys:
+		// Prefix is optional for listing
+		prefix, _ := str("prefix")
+		return c.claims.CanRead(prefix)
+	case kv.CmdReadBulk:
+		keys, ok := request.Data["keys"].([]interface{})
+		if !ok {
+			return false
+		}
+		for _, key := range keys {
+			keyStr, ok := key.(string)
+			if !ok || !c.claims.CanRead(keyStr) {
+				return false
+			}
+		}
+		return true
+	case kv.CmdWriteKey, kv.CmdRemoveKey:
+		key, ok := str("key")
+		return ok && c.canWrite(key)
+	case kv.CmdWriteBulk:
+		for key := range request.Data {
+			if !c.canWrite(key) {
+				return false
+			}
+		}
+		return true
+	case kv.CmdProtoVersion, kv.CmdAuthRequest, kv.CmdAuthChallenge:
+		// Commands that don't touch keys
+		return true
+	}
+
+	// Unknown commands could touch keys in ways we don't check
+	return false
+}
+
+func (c *scopedClient) canWrite(key string) bool {
+	if c.claims.CanWrite(key) {
+		return true
+	}
+	if c.claims.HasScope(auth.ScopeLoyaltyRPC) {
+		for _, rpcKey := range loyaltyRPCKeys {
+			if key == rpcKey {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *scopedClient) SetUID(uid int64) {
+	c.uid = uid
+}
+
+func (c *scopedClient) UID() int64 {
+	return c.uid
+}
+
+func (c *scopedClient) SendJSON(data interface{}) {
+	msg, _ := jsoniter.ConfigFastest.Marshal(data)
+	c.send <- msg
+}
+
+func (c *scopedClient) SendMessage(data []byte) {
+	c.send <- data
+}
+
+func (c *scopedClient) Options() kv.ClientOptions {
+	return c.options
+}
+
+func (c *scopedClient) Close() {
+	close(c.send)
+}
+
+// Make sure we are implementing the kilovolt client interface
+var _ kv.Client = &scopedClient{}
@@ -0,0 +1,73 @@
+package stulbe
+
+import (
+	"testing"
+
+	kv "github.com/strimertul/kilovolt/v8"
+
+	"github.com/strimertul/stulbe/api"
+	"github.com/strimertul/stulbe/auth"
+)
+
+func TestScopedClientAllowed(t *testing.T) {
+	scoped := &scopedClient{claims: &auth.UserClaims{
+		User:  "streamer",
+		Level: auth.ULStreamer,
+		Scopes: []string{
+			auth.ScopeKVReadPrefix + "overlay/",
+			auth.ScopeKVWritePrefix + "chat/",
+		},
+	}}
+	rpc := &scopedClient{claims: &auth.UserClaims{
+		User:   "streamer",
+		Level:  auth.ULStreamer,
+		Scopes: []string{auth.ScopeLoyaltyRPC},
+	}}
+	full := &scopedClient{claims: &auth.UserClaims{
+		User:  "streamer",
+		Level: auth.ULStreamer,
+	}}
+
+	tests := []struct {
+		name     string
+		client   *scopedClient
+		cmd      string
+		data     map[string]interface{}
+		expected bool
+	}{
+		{"read in read scope", scoped, kv.CmdReadKey, map[string]interface{}{"key": "overlay/title"}, true},
+		{"read in write scope", scoped, kv.CmdReadKey, map[string]interface{}{"key": "chat/last"}, true},
+		{"read outside scopes", scoped, kv.CmdReadKey, map[string]interface{}{"key": "secret"}, false},
+		{"read without key", scoped, kv.CmdReadKey, map[string]interface{}{}, false},
+		{"subscribe in scope", scoped, kv.CmdSubscribeKey, map[string]interface{}{"key": "overlay/title"}, true},
+		{"subscribe prefix outside scopes", scoped, kv.CmdSubscribePrefix, map[string]interface{}{"prefix": "over"}, false},
+		{"read prefix in scope", scoped, kv.CmdReadPrefix, map[string]interface{}{"prefix": "overlay/"}, true},
+		{"list everything", scoped, kv.CmdListKeys, map[string]interface{}{}, false},
+		{"list in scope", scoped, kv.CmdListKeys, map[string]interface{}{"prefix": "chat/"}, true},
+		{"read bulk in scopes", scoped, kv.CmdReadBulk, map[string]interface{}{"keys": []interface{}{"overlay/a", "chat/b"}}, true},
+		{"read bulk partly outside scopes", scoped, kv.CmdReadBulk, map[string]interface{}{"keys": []interface{}{"overlay/a", "secret"}}, false},
+		{"read bulk with invalid key", scoped, kv.CmdReadBulk, map[string]interface{}{"keys": []interface{}{"overlay/a", 42}}, false},
+		{"read bulk without keys", scoped, kv.CmdReadBulk, map[string]interface{}{}, false},
+		{"write in write scope", scoped, kv.CmdWriteKey, map[string]interface{}{"key": "chat/last", "data": "hi"}, true},
+		{"write in read scope", scoped, kv.CmdWriteKey, map[string]interface{}{"key": "overlay/title", "data": "hi"}, false},
+		{"remove in write scope", scoped, kv.CmdRemoveKey, map[string]interface{}{"key": "chat/last"}, true},
+		{"remove in read scope", scoped, kv.CmdRemoveKey, map[string]interface{}{"key": "overlay/title"}, false},
+		{"write bulk in scope", scoped, kv.CmdWriteBulk, map[string]interface{}{"chat/a": "1", "chat/b": "2"}, true},
+		{"write bulk partly outside scope", scoped, kv.CmdWriteBulk, map[string]interface{}{"chat/a": "1", "overlay/b": "2"}, false},
+		{"version", scoped, kv.CmdProtoVersion, nil, true},
+		{"auth request", scoped, kv.CmdAuthRequest, nil, true},
+		{"unknown command", scoped, "kfuture", map[string]interface{}{"key": "chat/a"}, false},
+		{"unknown command with full access", full, "kfuture", nil, false},
+		{"loyalty rpc key", rpc, kv.CmdWriteKey, map[string]interface{}{"key": api.KVExLoyaltyRedeem, "data": "{}"}, true},
+		{"loyalty rpc bulk", rpc, kv.CmdWriteBulk, map[string]interface{}{api.KVExLoyaltyRedeem: "{}", api.KVExLoyaltyContribute: "{}"}, true},
+		{"loyalty rpc other key", rpc, kv.CmdWriteKey, map[string]interface{}{"key": "chat/a", "data": "{}"}, false},
+		{"full access read", full, kv.CmdReadKey, map[string]interface{}{"key": "secret"}, true},
+		{"full access write bulk", full, kv.CmdWriteBulk, map[string]interface{}{"a": "1", "b": "2"}, true},
+	}
+	for _, test := range tests {
+		request := kv.Request{CmdName: test.cmd, Data: test.data}
+		if allowed := test.client.allowed(request); allowed != test.expected {
+			t.Errorf("%s: expected allowed=%v, got %v", test.name, test.expected, allowed)
+		}
+	}
+}